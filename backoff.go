@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff decides how long to wait before the next attempt after a request has been refused.
+// attempt counts consecutive refusals, starting at 1.
+type backoff interface {
+	next(attempt int) time.Duration
+}
+
+// constantBackoff waits the same delay before every attempt.
+type constantBackoff struct {
+	delay time.Duration
+}
+
+func (b constantBackoff) next(attempt int) time.Duration {
+	return b.delay
+}
+
+// linearBackoff waits initial before the first attempt and step longer before each one after,
+// never waiting longer than max.
+type linearBackoff struct {
+	initial time.Duration
+	step    time.Duration
+	max     time.Duration
+}
+
+func (b linearBackoff) next(attempt int) time.Duration {
+	delay := b.initial + time.Duration(attempt-1)*b.step
+	if b.max > 0 && delay > b.max {
+		return b.max
+	}
+	return delay
+}
+
+// exponentialBackoff waits initial before the first attempt and multiplies the delay by factor before
+// each one after, never waiting longer than max.
+type exponentialBackoff struct {
+	initial time.Duration
+	factor  float64
+	max     time.Duration
+}
+
+func (b exponentialBackoff) next(attempt int) time.Duration {
+	delay := float64(b.initial)
+	for i := 1; i < attempt; i++ {
+		delay *= b.factor
+		if b.max > 0 && delay >= float64(b.max) {
+			return b.max
+		}
+	}
+	return time.Duration(delay)
+}
+
+// decorrelatedJitterBackoff waits a random delay between base and three times the previous delay,
+// never waiting longer than max, which spreads out producers that were refused at the same time.
+// It remembers the previous delay, so each producer should use its own decorrelatedJitterBackoff.
+type decorrelatedJitterBackoff struct {
+	base     time.Duration
+	max      time.Duration
+	previous time.Duration
+}
+
+func (b *decorrelatedJitterBackoff) next(attempt int) time.Duration {
+	if attempt <= 1 || b.previous < b.base {
+		b.previous = b.base
+	}
+	upper := 3 * b.previous
+	delay := b.base
+	if upper > b.base {
+		delay += time.Duration(rand.Int63n(int64(upper - b.base)))
+	}
+	if b.max > 0 && delay > b.max {
+		delay = b.max
+	}
+	b.previous = delay
+	return delay
+}
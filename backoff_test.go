@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelaySequences(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		backoff backoff
+		want    []time.Duration
+	}{
+		{"constant", constantBackoff{delay: time.Second}, []time.Duration{time.Second, time.Second, time.Second}},
+		{"linear", linearBackoff{initial: time.Second, step: 2 * time.Second, max: 6 * time.Second},
+			[]time.Duration{time.Second, 3 * time.Second, 5 * time.Second, 6 * time.Second}},
+		{"exponential", exponentialBackoff{initial: 100 * time.Millisecond, factor: 2, max: time.Second},
+			[]time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for i, want := range tc.want {
+				if got := tc.backoff.next(i + 1); got != want {
+					t.Errorf("attempt %d waits %s, want %s", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecorrelatedJitterBackoffStaysInBounds(t *testing.T) {
+	b := &decorrelatedJitterBackoff{base: 10 * time.Millisecond, max: time.Second}
+	previous := b.base
+	for attempt := 1; attempt <= 200; attempt++ {
+		delay := b.next(attempt)
+		upper := 3 * previous
+		if attempt == 1 {
+			upper = 3 * b.base
+		}
+		if upper > b.max {
+			upper = b.max
+		}
+		if delay < b.base || delay > upper {
+			t.Fatalf("attempt %d waits %s, want between %s and %s", attempt, delay, b.base, upper)
+		}
+		previous = delay
+	}
+	// A fresh run of refusals starts over from base.
+	if delay := b.next(1); delay >= 3*b.base {
+		t.Fatalf("first attempt of a new run waits %s, want less than %s", delay, 3*b.base)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// bucketConfig is the tunable configuration of a bucket, as set by initializeBucket,
+// initializeBucketFromEnv, or by setting the bucket's fields directly afterwards.
+type bucketConfig struct {
+	name           string
+	capacity       int
+	workerMin      int
+	workerCap      int
+	processingTime time.Duration
+	scaleInterval  time.Duration
+	idleTimeout    time.Duration
+	maxQueueWait   time.Duration
+	batchSize      int
+}
+
+// config returns the bucket's current configuration.
+func (bucket *leakyBucket) config() bucketConfig {
+	return bucketConfig{
+		name:           bucket.name,
+		capacity:       bucket.capacity(),
+		workerMin:      bucket.workerMin,
+		workerCap:      bucket.workerCap,
+		processingTime: bucket.processingTime,
+		scaleInterval:  bucket.scaleInterval,
+		idleTimeout:    bucket.idleTimeout,
+		maxQueueWait:   bucket.maxQueueWait,
+		batchSize:      bucket.batchSize,
+	}
+}
+
+// configDiff compares the bucket's current configuration against desired, returning a description of
+// each field that has drifted from it, in field order. It returns nothing when they match.
+func (bucket *leakyBucket) configDiff(desired bucketConfig) []string {
+	current := bucket.config()
+	fields := []struct {
+		name    string
+		current interface{}
+		desired interface{}
+	}{
+		{"name", current.name, desired.name},
+		{"capacity", current.capacity, desired.capacity},
+		{"workerMin", current.workerMin, desired.workerMin},
+		{"workerCap", current.workerCap, desired.workerCap},
+		{"processingTime", current.processingTime, desired.processingTime},
+		{"scaleInterval", current.scaleInterval, desired.scaleInterval},
+		{"idleTimeout", current.idleTimeout, desired.idleTimeout},
+		{"maxQueueWait", current.maxQueueWait, desired.maxQueueWait},
+		{"batchSize", current.batchSize, desired.batchSize},
+	}
+
+	var drifted []string
+	for _, field := range fields {
+		if field.current != field.desired {
+			drifted = append(drifted, fmt.Sprintf("%s: %v, want %v", field.name, field.current, field.desired))
+		}
+	}
+	return drifted
+}
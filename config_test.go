@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigDiffListsOnlyDriftedFields(t *testing.T) {
+	bucket := newTestBucket(10, 4, 1)
+	baseline := bucket.config()
+	if diff := bucket.configDiff(baseline); len(diff) != 0 {
+		t.Fatalf("configDiff against the bucket's own config = %v, want no drift", diff)
+	}
+
+	bucket.workerCap = 8
+	bucket.maxQueueWait = time.Second
+	diff := bucket.configDiff(baseline)
+	want := []string{"workerCap: 8, want 4", "maxQueueWait: 1s, want 0s"}
+	if strings.Join(diff, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("configDiff = %q, want %q", diff, want)
+	}
+
+	baseline.workerCap, baseline.maxQueueWait = 8, time.Second
+	if diff := bucket.configDiff(baseline); len(diff) != 0 {
+		t.Fatalf("configDiff once the baseline matches = %v, want no drift", diff)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// initializeBucketFromEnv initializes a leakyBucket configured from environment variables, for running the
+// simulation in containers. Every variable name is prefixed with prefix, e.g. a prefix of "DEMO_" reads
+// DEMO_BUCKET_CAPACITY. The variables read are:
+//
+//	BUCKET_NAME      the bucket's name, defaulting to "Global Bucket"
+//	BUCKET_CAPACITY  how many requests the bucket holds, defaulting to 20
+//	WORKER_MIN       the minimum number of workers, defaulting to 3
+//	WORKER_MAX       the maximum number of workers, defaulting to 5
+//	PROCESSING_TIME  how long each request takes to process as a Go duration, defaulting to 750ms
+//	SCALE_INTERVAL   how often the worker pool is adjusted as a Go duration, defaulting to 250ms
+//
+// Missing variables use their defaults. A malformed or out of range value returns an error naming the variable.
+func initializeBucketFromEnv(prefix string) (*leakyBucket, error) {
+	name := os.Getenv(prefix + "BUCKET_NAME")
+	if name == "" {
+		name = "Global Bucket"
+	}
+	capacity, err := envInt(prefix+"BUCKET_CAPACITY", 20)
+	if err != nil {
+		return nil, err
+	}
+	workerMin, err := envInt(prefix+"WORKER_MIN", 3)
+	if err != nil {
+		return nil, err
+	}
+	workerCap, err := envInt(prefix+"WORKER_MAX", 5)
+	if err != nil {
+		return nil, err
+	}
+	processingTime, err := envDuration(prefix+"PROCESSING_TIME", 750*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	scaleInterval, err := envDuration(prefix+"SCALE_INTERVAL", 250*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case capacity < 1:
+		return nil, fmt.Errorf("%sBUCKET_CAPACITY must be at least 1, got %d", prefix, capacity)
+	case workerMin < 1:
+		return nil, fmt.Errorf("%sWORKER_MIN must be at least 1, got %d", prefix, workerMin)
+	case workerCap < workerMin:
+		return nil, fmt.Errorf("%sWORKER_MAX must be at least %sWORKER_MIN (%d), got %d", prefix, prefix, workerMin, workerCap)
+	case scaleInterval <= 0:
+		return nil, fmt.Errorf("%sSCALE_INTERVAL must be positive, got %s", prefix, scaleInterval)
+	case processingTime < 0:
+		return nil, fmt.Errorf("%sPROCESSING_TIME must not be negative, got %s", prefix, processingTime)
+	}
+
+	bucket := initializeBucket(name, capacity, workerCap, workerMin)
+	bucket.processingTime = processingTime
+	bucket.scaleInterval = scaleInterval
+	return bucket, nil
+}
+
+// envInt returns the integer value of the environment variable key, or fallback if it is not set.
+func envInt(key string, fallback int) (int, error) {
+	raw, ok := os.LookupEnv(key)
+	if !ok || raw == "" {
+		return fallback, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer, got %q", key, raw)
+	}
+	return value, nil
+}
+
+// envDuration returns the duration value of the environment variable key, or fallback if it is not set.
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	raw, ok := os.LookupEnv(key)
+	if !ok || raw == "" {
+		return fallback, nil
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration such as 750ms, got %q", key, raw)
+	}
+	return value, nil
+}
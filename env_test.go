@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInitializeBucketFromEnv(t *testing.T) {
+	t.Setenv("TEST_BUCKET_NAME", "Env Bucket")
+	t.Setenv("TEST_BUCKET_CAPACITY", "40")
+	t.Setenv("TEST_WORKER_MIN", "2")
+	t.Setenv("TEST_WORKER_MAX", "8")
+	t.Setenv("TEST_PROCESSING_TIME", "20ms")
+	bucket, err := initializeBucketFromEnv("TEST_")
+	if err != nil {
+		t.Fatalf("initializeBucketFromEnv: %v", err)
+	}
+	if bucket.name != "Env Bucket" || bucket.capacity() != 40 || bucket.workerMin != 2 || bucket.workerCap != 8 {
+		t.Errorf("bucket = %s with capacity %d and %d to %d workers, want Env Bucket with capacity 40 and 2 to 8 workers",
+			bucket.name, bucket.capacity(), bucket.workerMin, bucket.workerCap)
+	}
+	if bucket.processingTime != 20*time.Millisecond || bucket.scaleInterval != 250*time.Millisecond {
+		t.Errorf("processing time %s and scale interval %s, want 20ms and the 250ms default", bucket.processingTime, bucket.scaleInterval)
+	}
+}
+
+func TestInitializeBucketFromEnvRejectsBadValues(t *testing.T) {
+	for _, tc := range []struct {
+		key, value, want string
+	}{
+		{"BUCKET_CAPACITY", "lots", "TEST_BUCKET_CAPACITY must be an integer"},
+		{"BUCKET_CAPACITY", "0", "TEST_BUCKET_CAPACITY must be at least 1"},
+		{"WORKER_MAX", "1", "TEST_WORKER_MAX must be at least TEST_WORKER_MIN"},
+		{"PROCESSING_TIME", "soon", "TEST_PROCESSING_TIME"},
+		{"SCALE_INTERVAL", "0s", "TEST_SCALE_INTERVAL must be positive"},
+	} {
+		t.Run(tc.key+"="+tc.value, func(t *testing.T) {
+			t.Setenv("TEST_"+tc.key, tc.value)
+			bucket, err := initializeBucketFromEnv("TEST_")
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("initializeBucketFromEnv = %v, %v, want an error containing %q", bucket, err, tc.want)
+			}
+		})
+	}
+}
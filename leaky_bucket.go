@@ -1,7 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -9,121 +21,2794 @@ import (
 type request struct {
 	requestType string
 	requestedAt time.Time
+	// sequence is the order the request was admitted to its bucket in, starting from 0.
+	sequence uint64
+	// attempts is how many times the request has been retried.
+	attempts int
+	// key identifies requests that supersede one another when the bucket compacts by key.
+	key string
+	// source identifies where the request came from, such as the host a replayed trace was captured on,
+	// so its requestedAt can be corrected for that source's clock skew.
+	source string
+	// skewCorrected is set once requestedAt is on the common baseline, either corrected for source's clock
+	// skew on admission or taken from the local clock, so it is never corrected twice.
+	skewCorrected bool
+	// probe, when set, marks the synthetic request ready sends through the bucket, and is closed once the
+	// request has been processed. A probe is kept out of the per-type counts, the audit log, and onComplete.
+	probe chan struct{}
 }
 
+// retry returns a copy of the request to re-enqueue, with a fresh requestedAt so its age starts over
+// and its attempt count incremented. The fresh requestedAt comes from the local clock, so it is not corrected
+// for the source's clock skew. The original request is left unchanged.
+func (req request) retry() request {
+	req.requestedAt = time.Now()
+	req.skewCorrected = true
+	req.attempts++
+	return req
+}
+
+var (
+	// errBucketFull is returned when a request is refused because the bucket has no room for it.
+	errBucketFull = errors.New("bucket is full")
+	// errWaitTooLong is returned when a request is refused because it would wait longer than
+	// the bucket's maxQueueWait before a worker could pick it up.
+	errWaitTooLong = errors.New("estimated wait exceeds the maximum queue wait")
+	// errNotInitialized is returned when a bucket is used without being created by initializeBucket.
+	// Its requestChannel is nil, so any send or receive on it would block forever.
+	errNotInitialized = errors.New("bucket has not been initialized")
+	// errShutdown is returned when a request is refused because the bucket is shutting down.
+	errShutdown = errors.New("bucket is shutting down")
+	// errSuperseded is recorded when a queued request is discarded because a later request with the
+	// same key was enqueued while the bucket compacts by key.
+	errSuperseded = errors.New("request superseded by a later request with the same key")
+	// errMemoryPressure is recorded when a queued request is shed, or a request is refused while intake
+	// is paused, because the process is under memory pressure.
+	errMemoryPressure = errors.New("intake paused under memory pressure")
+	// errStalled is returned when a request is refused while intake is paused for the worker pool to
+	// recover from a stall.
+	errStalled = errors.New("intake paused while the worker pool recovers from a stall")
+	// errKeyLimit is returned when a request is refused because its key already has keyLimit requests queued.
+	errKeyLimit = errors.New("key has reached its limit of queued requests")
+	// errTypePaused is returned when a request is refused because its type has been paused by pauseType.
+	errTypePaused = errors.New("request type is paused")
+)
+
 // leakyBucket simulates how a leaky bucket rate limiter might be modeled.
 type leakyBucket struct {
 	requestChannel chan request
 	name           string
+	// policy documents the rate limit the bucket enforces and who owns it. It is guarded by mu.
+	policy policy
+	// tags are arbitrary labels, such as region or service, used to group buckets when aggregating stats.
+	tags map[string]string
 	// The maximum number of workers allowed to be operating at once on this bucket.
 	workerCap int
 	// The minimum number of workers that must always be on standby for a bucket.
 	workerMin int
+	// maxProduced, when positive, is how many requests receiveRequests offers before it stops, for bounded runs.
+	maxProduced int
+	// producerBackoff decides how long receiveRequests waits before sending again after finding the bucket full.
+	producerBackoff backoff
+	// processingTime is how long a worker spends processing a single request.
+	processingTime time.Duration
+	// minProcessingTime is a floor every request takes to process, modeling fixed overhead such as
+	// connection setup that applies no matter how quick the request itself would otherwise be. It applies
+	// per request, so a batch takes at least minProcessingTime for each request in it, processed by the
+	// bucket's process function or not.
+	minProcessingTime time.Duration
+	// thinkTime, when set, is the distribution each request's processing time is drawn from in place of
+	// the fixed processingTime. Samples come from rng, guarded by rngMu, which seedRandom can reseed so
+	// a simulation can be reproduced.
+	thinkTime thinkTime
+	rng       *rand.Rand
+	rngMu     sync.Mutex
+	// estimateWeight, when positive, turns on online estimation of processing times: each completion moves
+	// the estimate for its request type, and the estimate across all types, this fraction of the way toward
+	// the time it actually took. estimateWait and worstCaseWait then use the estimates instead of meanServiceTime.
+	estimateWeight float64
+	// prefillSpread, when positive, staggers the requestedAt timestamps of prefilled requests backward over
+	// this window, so an initial backlog has a spread of ages instead of all appearing equally old.
+	prefillSpread time.Duration
+	// launch, when set, starts each Go routine the bucket runs workers, the leak loop, and resumed request
+	// delivery on, named after what it runs, in place of a plain go statement. A supervisor sets it so a
+	// panic in any of them is reported rather than crashing the program. It must be set before any workers
+	// are spawned or the warm pool or leak gate is started.
+	launch func(name string, fn func())
+	// process, when set, is the work workers perform on each batch of requests. When nil, workers simulate
+	// work by sleeping for serviceTime per batch. It is swapped atomically by setProcess.
+	process atomic.Pointer[processFunc]
+	// dryRun makes workers go through the full dequeue and accounting flow without doing any work,
+	// only validating each request, to check throughput and scaling without side effects.
+	dryRun bool
+	// validate, when set, is called on each request in dry run mode. Invalid requests are reported
+	// but are still counted as processed.
+	validate func(req request) error
+	// compactByKey discards a queued request when a later request with the same key is enqueued, so only
+	// the latest request for each key is processed. Superseded requests keep their place in the queue
+	// until a worker reaches and discards them.
+	compactByKey bool
+	// batchSize is the most requests a worker pulls off the bucket to process together.
+	// A batchSize of 1 or less processes requests one at a time.
+	batchSize int
+	// batchWait is the longest a worker waits for more requests to arrive when filling a batch.
+	batchWait time.Duration
+	// clock returns the current time for all of the bucket's time dependent logic.
+	// It defaults to time.Now and can be replaced to control time in simulations.
+	clock func() time.Time
+	// timestampClock, when set, is used instead of clock to stamp requestedAt on new requests.
+	// Setting it to a coarseClock's now avoids calling time.Now for every request at high throughput.
+	timestampClock func() time.Time
+	// coarse, when set by useCoarseClock, is the coarseClock behind timestampClock, stopped on shutdown.
+	coarse *coarseClock
+	// completionHistory is how long completion times and full periods are kept for measuring rates over a window.
+	completionHistory time.Duration
+	// statsInterval is how often the bucket's interval counters are reset.
+	statsInterval time.Duration
+	// pace, when positive, is the minimum spacing between any two workers starting to process requests.
+	// It shapes bursty intake into a steady processing cadence however quickly requests arrive.
+	pace time.Duration
+	// workerLifetime, when positive, is how long a worker runs before retiring itself, like a process
+	// being cycled. A replacement is spawned, before the worker leaves the pool, if retiring would leave
+	// the pool below workerMin.
+	workerLifetime time.Duration
+	// workerBudget, when positive, is how many requests each worker may process per budgetRefill. A worker
+	// that spends its budget parks until the budget refills, even with requests waiting, leaving them to
+	// other workers so no single worker monopolizes a shared downstream. A batch may overdraw the budget.
+	// budgetRefill must be positive when workerBudget is set.
+	workerBudget int
+	budgetRefill time.Duration
+	// idleTimeout, when positive, is how long a worker waits without receiving a request before
+	// reporting that it is idle. It keeps waiting for requests afterwards.
+	idleTimeout time.Duration
+	// releases, when set by startLeakGate, gates workers so they only take a request off the bucket when
+	// the leak loop releases one, making processing starts follow the leak schedule exactly.
+	releases chan struct{}
+	// leakBurst is the most unused releases the leak gate saves up while the bucket is empty.
+	leakBurst int
+	// leakInterval is how often the leak gate releases a request, set by startLeakGate.
+	leakInterval time.Duration
+	// activations, when set by startWarmPool, hands newly spawned workers to Go routines parked in the
+	// warm pool, and parked counts how many are waiting.
+	activations chan worker
+	parked      atomic.Int64
+	// scaleInterval is how often the worker pool size adjuster re-evaluates the pool.
+	scaleInterval time.Duration
+	// scaleLimiter, when set, gates every spawn or removal of a worker. Sharing one limiter between
+	// buckets bounds the rate of scaling actions across all of them.
+	scaleLimiter *scaleLimiter
+	// adjusting is set while a worker pool size adjuster is running on the bucket, and detach asks the
+	// running adjuster to exit, closing the channel it is sent once it has, so another can take over.
+	adjusting atomic.Bool
+	detach    chan chan struct{}
+	// createdAt is when the bucket was initialized, used to determine whether it is still warming up.
+	createdAt time.Time
+	// warmup is how long after creation the bucket is considered to be warming up.
+	warmup time.Duration
+	// warmupAcceptOnly makes the bucket accept requests as normal during warmup while deferring
+	// any worker pool scaling until warmup has ended. When false, warmup does not change behavior.
+	warmupAcceptOnly bool
+	// oscillationWindow is how far back watermark crossings are counted when measuring oscillation.
+	oscillationWindow time.Duration
+	// maxQueueWait, when positive, refuses requests whose estimated wait before being picked up by a
+	// worker exceeds it, rather than queueing requests that would already be too late once processed.
+	maxQueueWait time.Duration
+	// criticalWait, when positive, is how long a request may wait in the queue before the worker pool
+	// size adjuster immediately scales the pool to workerCap rather than adding workers one at a time.
+	criticalWait time.Duration
+	// memoryPressure, when set, is checked by the worker pool size adjuster every scaleInterval. While it
+	// reports pressure, pressureShed of the queued requests are shed, oldest first, and intake is paused
+	// for pressurePause, refusing new requests until the pause runs out.
+	memoryPressure func() bool
+	pressureShed   float64
+	pressurePause  time.Duration
+	// stallWindow, when positive, is checked by the worker pool size adjuster's watchdog every scaleInterval.
+	// If no request has completed within it while the oldest queued request has waited longer than it, the
+	// pool is treated as wedged: every worker is stopped and replaced, and intake is paused for stallPause.
+	// Each further stall without a completion in between doubles the window, up to maxStallBackoff doublings.
+	stallWindow time.Duration
+	stallPause  time.Duration
+	// keyLimit, when positive, is the most requests with the same key that may be queued at once, so no
+	// single key can take up the whole bucket. Further requests for the key are refused until some of its
+	// queued requests are dequeued, while other keys are still admitted into the remaining capacity.
+	keyLimit int
+	// holdPaused makes requests of a type paused by pauseType wait until the type is resumed, set aside by
+	// the worker that dequeued them so other types keep flowing. Otherwise they are refused at admission.
+	holdPaused bool
+	// resumed delivers held requests back to the workers once their type is resumed.
+	resumed chan request
+	// clockSkew holds how far ahead of the common baseline each source's clock runs, keyed by source.
+	// Admitted requests have their requestedAt corrected by their source's skew, so requests replayed
+	// from sources with skewed clocks are aged and ordered against one another correctly.
+	clockSkew map[string]time.Duration
+	// onEnqueue, when set, is called with each request as it is admitted and before it is placed on
+	// the bucket, giving it a chance to enrich or tag the request. Changes it makes are seen by workers.
+	onEnqueue func(*request)
+	// auditWriter, when set, receives an append-only record of every processed request in the order
+	// processing completed, including when it completed and which worker processed it.
+	auditWriter io.Writer
+	// auditMu serializes writes to auditWriter so records from concurrent workers never interleave.
+	auditMu sync.Mutex
+	// traceLimit, when positive, is how many of the most recently processed requests have their
+	// lifecycles kept for writeTrace.
+	traceLimit int
+	// onComplete, when set, is called with each request once a worker has finished processing it.
+	onComplete func(request)
+	// orderedCompletions holds completions in a reorder buffer so onComplete is called in the order
+	// requests were admitted, even when parallel workers finish them out of order.
+	orderedCompletions bool
+	// completionMu guards the reorder buffer below and serializes calls to onComplete.
+	completionMu sync.Mutex
+	// nextCompletion is the sequence number of the next completion to release to onComplete.
+	nextCompletion uint64
+	// pendingCompletions holds completions finished ahead of nextCompletion. A nil entry marks a
+	// request that left the bucket without being processed and is skipped when released.
+	pendingCompletions map[uint64]*request
+	// alertLevels are queue depths, as fractions of capacity in ascending order, that raise an alert
+	// through onThreshold when crossed, e.g. warn at 0.7 and critical at 0.9.
+	alertLevels []alertLevel
+	// alertHysteresis is how far, as a fraction of capacity, the depth must fall below an alert level
+	// before that level is cleared.
+	alertHysteresis float64
+	// onThreshold, when set, is called with the new alert level and queue depth each time the active
+	// alert level changes. It is called synchronously as requests are enqueued and dequeued, so it
+	// must not add requests to the bucket itself.
+	onThreshold func(level string, depth int)
+	// alertMu guards activeAlert and serializes calls to onThreshold.
+	alertMu sync.Mutex
+	// activeAlert is how many of alertLevels the depth is currently at or above.
+	activeAlert int
+	// profile records timings of the bucket's hot path operations while profiling is enabled.
+	profile *hotPathProfile
+	// shadow, when set, is sent a copy of every request this bucket admits so a different configuration
+	// can be tried against live traffic. The shadow admits, drops, and processes the copies independently
+	// and its outcomes never affect this bucket or its counters.
+	shadow *leakyBucket
+	// admissionLog, when set, receives a record of admission decisions, distinct from the audit of
+	// processed requests, including the reason code for each decision.
+	admissionLog io.Writer
+	// admissionSampleRate is the fraction of admission decisions, from 0 to 1, written to admissionLog.
+	admissionSampleRate float64
+	// admissionLogMu serializes writes to admissionLog.
+	admissionLogMu sync.Mutex
+	// intake serializes requests being placed on the bucket, so a capacity check and the send
+	// that follows it cannot interleave with other producers or with a queue swap.
+	intake sync.Mutex
+	// queuedAtMu guards queuedAt, queuedTypes, queuedKeys, admitted, and left.
+	queuedAtMu sync.Mutex
+	// queuedAt holds when each request currently on the bucket was enqueued, oldest first. Since the
+	// bucket is FIFO, every receive from requestChannel removes the oldest entry.
+	queuedAt []time.Time
+	// queuedTypes counts the requests currently on the bucket by their requestType.
+	queuedTypes map[string]int
+	// queuedKeys counts the requests currently on the bucket by their key, leaving out requests without one.
+	queuedKeys map[string]int
+	// inFlight is the number of requests workers have taken off the bucket and not yet finished. It is only
+	// changed while holding queuedAtMu or mu, alongside the queue or counter the requests move to or from.
+	inFlight atomic.Int64
+	// left is the number of admitted requests that left the bucket without being processed, such as those
+	// shed, swapped out, extracted, or superseded.
+	left uint64
+	// leftReasons tallies the requests counted in left that the bucket discarded itself, rather than handed
+	// back to a caller, by the reason code they were discarded with, such as superseded.
+	leftReasons map[string]uint64
+	// goroutines is the number of Go routines currently managing the bucket: producers, workers, the worker
+	// pool size adjuster, and the leak loop.
+	goroutines atomic.Int64
+	// fullSince is when the bucket last became completely full, or the zero time if it is not full.
+	// It and the full period fields below are guarded by queuedAtMu.
+	fullSince time.Time
+	// fullTotal is the cumulative time the bucket spent full across completed full periods.
+	fullTotal time.Duration
+	// fullPeriods holds the full periods that ended within the completion history, oldest first.
+	fullPeriods []timeSpan
+	// shuttingDown is set once shutdown has been called, after which new requests are refused.
+	// It is guarded by intake.
+	shuttingDown bool
+	// pausedUntil is when intake resumes after being paused, such as under memory pressure, and pausedFor
+	// is the error requests are refused with until then. They are guarded by intake.
+	pausedUntil time.Time
+	pausedFor   error
+	// shutdownOnce ensures intake is only closed once, and stopOnce that the workers are only stopped once
+	// the bucket has drained. stopping holds the workers that were stopped, for later shutdown calls to await.
+	shutdownOnce sync.Once
+	stopOnce     sync.Once
+	stopping     []worker
+	// drained wakes shutdown whenever a request leaves the bucket or finishes processing, so it can check
+	// whether the bucket has drained.
+	drained chan struct{}
+	// closing is closed as soon as shutdown is called, waking anything waiting on the bucket.
+	closing chan struct{}
+	// slotFreed wakes a caller waiting in acquire when release frees a slot on a bucket used as a semaphore.
+	slotFreed chan struct{}
+	// stopped is closed once the bucket has drained and its workers are being stopped.
+	stopped chan struct{}
+	// highSince is when the queue depth last rose above the high watermark without a scale up since,
+	// or the zero time if it is not above it. It is guarded by queuedAtMu.
+	highSince time.Time
+	// admitted is the number of requests admitted so far, and the next sequence number to assign.
+	// It is only changed while holding both intake and queuedAtMu, so either one is enough to read it.
+	admitted uint64
+	// mu guards the processing counters below, which are updated concurrently by workers.
+	mu sync.Mutex
+	// workers is the bucket's worker pool, holding every worker running on the bucket that has not been
+	// asked to stop.
+	workers []worker
+	// workersRegistered is how many workers have ever joined the pool, used to give new workers unique names.
+	workersRegistered int
+	// wedged holds the workers the stall watchdog removed from the pool that have not exited yet. They still
+	// hold a Go routine each, so they count against workerCap.
+	wedged []worker
+	// stalls is how many times in a row the stall watchdog has replaced the pool with no request completing.
+	stalls int
+	// processed is the total number of requests workers have pulled off the bucket and processed.
+	processed uint64
+	// completedAt holds when each request processed within the completion history finished, oldest first.
+	completedAt []time.Time
+	// nextStart is the earliest time the next request may start processing when pacing is enabled.
+	nextStart time.Time
+	// arrivals is the total number of requests that have entered the bucket.
+	arrivals uint64
+	// inSystem is the number of requests queued or being processed, and inSystemSince is when it last
+	// changed. inSystemArea accumulates inSystem over time, in request seconds, for averaging it.
+	inSystem      int
+	inSystemSince time.Time
+	inSystemArea  float64
+	// lastProgress is when a request last completed, or when the pool was last recovered from a stall.
+	lastProgress time.Time
+	// timeInSystem is the total time processed requests spent in the system, from requestedAt to completion.
+	timeInSystem time.Duration
+	// scaleReaction and maxScaleReaction are the most recent and longest times the worker pool took to
+	// scale up after the queue depth rose above the high watermark.
+	scaleReaction    time.Duration
+	maxScaleReaction time.Duration
+	// activationLatency is how long the most recently spawned worker took to start running, and
+	// warmActivations counts the workers that were activated from the warm pool.
+	activationLatency time.Duration
+	warmActivations   uint64
+	// dropped is the total number of requests the bucket has refused at admission. Requests discarded after
+	// being admitted are counted in left instead, never in both.
+	dropped uint64
+	// latestByKey holds the sequence number of the latest request enqueued for each key while compacting.
+	latestByKey map[string]uint64
+	// droppedReasons tallies dropped requests by the reason code they were refused with.
+	droppedReasons map[string]uint64
+	// currentInterval and lastInterval hold the counters for the stats interval in progress
+	// and the most recently completed one.
+	currentInterval intervalStats
+	lastInterval    intervalStats
+	// processedTypes tallies processed requests by their requestType.
+	processedTypes map[string]uint64
+	// pausedTypes holds the request types paused by pauseType, and held the requests of those types set
+	// aside while holding paused types. Held requests still count as in flight.
+	pausedTypes map[string]bool
+	held        []request
+	// traces holds the lifecycles of the most recently processed requests, oldest first, up to traceLimit.
+	traces []traceRecord
+	// observedTimes holds the estimated processing time of each request type while estimating online,
+	// with the estimate across all types held under the empty request type.
+	observedTimes map[string]time.Duration
+	// lastZone is the watermark zone the adjuster last observed the queue depth in.
+	lastZone depthZone
+	// watermarkCrossings holds when the queue depth crossed a watermark within the oscillation window.
+	watermarkCrossings []time.Time
+}
+
+// timeSpan is a period of time between start and end.
+type timeSpan struct {
+	start time.Time
+	end   time.Time
+}
+
+// policy is governance metadata describing the rate limit a bucket enforces, which travels with the bucket.
+type policy struct {
+	// limits describes the limits enforced, e.g. "20 queued requests, 3 to 5 workers".
+	limits  string
+	owner   string
+	contact string
+	// sla describes the service level the bucket is expected to meet.
+	sla string
+}
+
+// bucketStats is a point in time summary of a bucket's queue, workers, and counters.
+type bucketStats struct {
+	name      string
+	depth     int
+	capacity  int
+	workers   int
+	admitted  uint64
+	inFlight  int64
+	processed uint64
+	left      uint64
+	dropped   uint64
+	// serviceRate is the requests per second the worker pool completed during the most recently
+	// completed stats interval.
+	serviceRate float64
+	// dropsByReason tallies dropped requests by the reason code they were refused with.
+	dropsByReason map[string]uint64
+	// leftByReason tallies the admitted requests the bucket discarded without processing, counted in left,
+	// by the reason code they were discarded with. Requests handed back to a caller are not tallied.
+	leftByReason map[string]uint64
+	// scaleReaction and maxScaleReaction are the most recent and longest times taken to scale up the
+	// worker pool after the queue depth rose above the high watermark.
+	scaleReaction    time.Duration
+	maxScaleReaction time.Duration
+	// warmPool is the number of workers parked in the warm pool, warmActivations how many workers were
+	// activated from it, and activationLatency how long the most recently spawned worker took to start.
+	warmPool          int
+	warmActivations   uint64
+	activationLatency time.Duration
+	policy            policy
+}
+
+// intervalStats holds the requests a bucket processed and dropped during a single stats interval.
+type intervalStats struct {
+	start     time.Time
+	processed uint64
+	dropped   uint64
+}
+
+// coarseClock caches the current time and refreshes it every resolution from a background Go routine,
+// so reading the time is a cheap atomic load rather than a call to time.Now. The time it reports is
+// never more than resolution behind the true time, until the clock is stopped.
+type coarseClock struct {
+	resolution time.Duration
+	nanos      atomic.Int64
+	// done is closed by stop to end the refresh Go routine, and stopOnce ensures it is only closed once.
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newCoarseClock initializes a coarseClock with the given resolution and starts refreshing it.
+// The clock refreshes until stop is called.
+func newCoarseClock(resolution time.Duration) *coarseClock {
+	clock := &coarseClock{resolution: resolution, done: make(chan struct{})}
+	clock.nanos.Store(time.Now().UnixNano())
+	go clock.refresh()
+	return clock
 }
 
+// refresh updates the cached time every resolution until the clock is stopped. It is intended to be
+// run as a Go routine.
+func (clock *coarseClock) refresh() {
+	ticker := time.NewTicker(clock.resolution)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-clock.done:
+			return
+		case tick := <-ticker.C:
+			clock.nanos.Store(tick.UnixNano())
+		}
+	}
+}
+
+// stop ends the refresh Go routine, leaving now reporting the last time cached. Stopping a clock that
+// has already been stopped is a no-op.
+func (clock *coarseClock) stop() {
+	clock.stopOnce.Do(func() { close(clock.done) })
+}
+
+// now returns the cached time.
+func (clock *coarseClock) now() time.Time {
+	return time.Unix(0, clock.nanos.Load())
+}
+
+// alertLevel is a named queue depth, as a fraction of the bucket's capacity, that raises an alert when crossed.
+type alertLevel struct {
+	name     string
+	fraction float64
+}
+
+// processFunc performs the work for a batch of requests a worker has taken off the bucket, which holds a
+// single request unless the bucket's batchSize is greater than 1.
+type processFunc func(batch []request)
+
+// depthZone describes where a bucket's queue depth sits relative to its scaling watermarks.
+type depthZone int
+
+const (
+	// belowLowWatermark means the bucket is using less than 10% of its capacity.
+	belowLowWatermark depthZone = iota
+	// betweenWatermarks means the bucket is neither nearly empty nor nearly full.
+	betweenWatermarks
+	// aboveHighWatermark means the bucket has less than 10% of its capacity open.
+	aboveHighWatermark
+)
+
 // worker is intended to be utilized with Go routines to simulate worker processes concurrently
 // pulling jobs off the leakyBucket.
 type worker struct {
 	name string
-	// quitChannel is used to send a signal to shut down a worker when scaling the worker pool.
+	// quitChannel is closed to signal a worker to shut down when scaling the worker pool.
 	quitChannel chan bool
+	// quitOnce ensures quitChannel is only closed once, however many times the worker is stopped.
+	quitOnce *sync.Once
+	// commandChannel delivers commands broadcast to the worker while it is running.
+	commandChannel chan workerCommand
+	// done is closed once the worker has stopped running.
+	done chan struct{}
+	// spawnedAt is when startWorker was asked to run the worker, and warm whether a Go routine parked in
+	// the warm pool took it, so processRequests can record how long the worker took to start running.
+	spawnedAt time.Time
+	warm      bool
+}
+
+// stop signals the worker to shut down. It never blocks, and stopping a worker that has already been
+// stopped or has exited is a no-op, so no caller is left waiting on a dead worker's quit channel.
+func (worker worker) stop() {
+	worker.quitOnce.Do(func() {
+		close(worker.quitChannel)
+	})
+}
+
+// workerCommand is an instruction broadcast to every worker on a bucket, such as asking them to reload configuration.
+type workerCommand struct {
+	name string
+	// acknowledge, when set, is called by each worker with its own name once it has handled the command.
+	acknowledge func(workerName string)
+}
+
+// newWorker initializes and returns a worker struct ready to be run with processRequests.
+func newWorker(name string) worker {
+	return worker{
+		name:           name,
+		quitChannel:    make(chan bool),
+		quitOnce:       &sync.Once{},
+		commandChannel: make(chan workerCommand),
+		done:           make(chan struct{}),
+	}
 }
 
 // receiveRequests simulates potentially what a server receiving traffic could look like.
 // This function is intended to be run as a Go routine and contains an infinite loop to simulate
-// a constant flow of traffic to the server.
-func receiveRequests(bucket leakyBucket) {
-	for {
-		if len(bucket.requestChannel) < cap(bucket.requestChannel) {
+// a constant flow of traffic to the server. When maxProduced is set, it returns once it has offered
+// that many requests, whether or not they were admitted.
+func receiveRequests(bucket *leakyBucket) {
+	bucket.goroutines.Add(1)
+	defer bucket.goroutines.Add(-1)
+	refusals := 0
+	for produced := 0; bucket.maxProduced <= 0 || produced < bucket.maxProduced; produced++ {
+		err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: bucket.requestTime()})
+		if !errors.Is(err, errBucketFull) {
+			refusals = 0
+		}
+		var delay time.Duration
+		switch {
+		case err == nil:
 			fmt.Println("New request received!")
-			bucket.requestChannel <- request{requestType: "HTML Request", requestedAt: time.Now()}
-			time.Sleep(100 * time.Millisecond)
-		} else {
+			delay = 100 * time.Millisecond
+		case errors.Is(err, errBucketFull):
+			refusals++
 			fmt.Println("Request queue full! Dropping requests.")
-			time.Sleep(3 * time.Second)
+			delay = bucket.producerBackoff.next(refusals)
+		case errors.Is(err, errNotInitialized):
+			fmt.Printf("Unable to receive requests: %v\n", err)
+			return
+		case errors.Is(err, errShutdown):
+			fmt.Println("Bucket is shutting down. No longer receiving requests.")
+			return
+		default:
+			fmt.Printf("Request rejected: %v\n", err)
+			delay = 100 * time.Millisecond
+		}
+		if !bucket.pause(delay) {
+			fmt.Println("Bucket is shutting down. No longer receiving requests.")
+			return
 		}
 	}
+	fmt.Printf("Offered all %d requests. No longer receiving requests.\n", bucket.maxProduced)
 }
 
 // processRequests handles the operations a worker can perform.
-// These include pulling requests off the bucket, being killed,
-// and sleeping for 10 seconds if no requests are present on the bucket.
+// These include pulling requests off the bucket, being killed, retiring at the end of its lifetime,
+// and reporting that it is idle if no requests arrive within idleTimeout. The worker blocks waiting
+// for whichever of these happens first, so a request is picked up as soon as it arrives.
+// A worker that has spent its workerBudget stops taking requests until its budget refills.
 // Intended to be run as a Go routine, this function contains an infinite loop
 // to keep the worker operating until no longer needed.
-func processRequests(worker worker, bucket leakyBucket) {
+func processRequests(worker worker, bucket *leakyBucket) {
+	if !bucket.initialized() {
+		fmt.Printf("%s is unable to process requests: %v\n", worker.name, errNotInitialized)
+		return
+	}
+	if !worker.spawnedAt.IsZero() {
+		bucket.recordActivation(time.Since(worker.spawnedAt), worker.warm)
+	}
+	bucket.goroutines.Add(1)
+	bucket.registerWorker(worker)
+	defer close(worker.done)
+	defer bucket.goroutines.Add(-1)
+	defer bucket.deregisterWorker(worker)
+
+	var retire <-chan time.Time
+	if bucket.workerLifetime > 0 {
+		lifetime := time.NewTimer(bucket.workerLifetime)
+		defer lifetime.Stop()
+		retire = lifetime.C
+	}
+
+	budget := bucket.workerBudget
+	var refill <-chan time.Time
+	if bucket.workerBudget > 0 {
+		refills := time.NewTicker(bucket.budgetRefill)
+		defer refills.Stop()
+		refill = refills.C
+	}
+	spend := func(requests int) {
+		budget -= requests
+		if bucket.workerBudget > 0 && budget <= 0 {
+			fmt.Printf("%s has spent its processing budget and is parked until it refills\n", worker.name)
+		}
+	}
+
 	for {
+		var idle <-chan time.Time
+		if bucket.idleTimeout > 0 {
+			idle = time.After(bucket.idleTimeout)
+		}
+
+		// When the bucket is gated by its leak loop, requests are only taken off the bucket once the
+		// leak loop releases one, so the worker waits on a release instead of on the bucket itself.
+		requests := bucket.requestChannel
+		var released <-chan struct{}
+		if bucket.releases != nil {
+			requests = nil
+			released = bucket.releases
+		}
+		resumed := bucket.resumed
+		if bucket.workerBudget > 0 && budget <= 0 {
+			requests = nil
+			released = nil
+			resumed = nil
+			idle = nil
+		}
+
 		select {
-		case req := <-bucket.requestChannel:
-			fmt.Printf("%s is processing a request of type %s\n", worker.name, req.requestType)
-			time.Sleep(750 * time.Millisecond)
+		case req := <-requests:
+			bucket.dequeued(req, true)
+			batch := bucket.fillBatch(req)
+			spend(len(batch))
+			bucket.processBatch(worker, batch)
+		case <-released:
+			select {
+			case req := <-bucket.requestChannel:
+				bucket.dequeued(req, true)
+				spend(1)
+				bucket.processBatch(worker, []request{req})
+			default:
+			}
+		case req := <-resumed:
+			spend(1)
+			bucket.processBatch(worker, []request{req})
+		case <-refill:
+			budget = bucket.workerBudget
+		case cmd := <-worker.commandChannel:
+			fmt.Printf("%s received command %s\n", worker.name, cmd.name)
+			if cmd.acknowledge != nil {
+				cmd.acknowledge(worker.name)
+			}
 		case <-worker.quitChannel:
 			fmt.Printf("Killing %s\n", worker.name)
 			return
-		default:
-			fmt.Printf("All requests processed. %s will sleep for 10 seconds\n", worker.name)
-			time.Sleep(10 * time.Second)
+		case <-retire:
+			fmt.Printf("%s has reached the end of its lifetime and is retiring\n", worker.name)
+			bucket.retireWorker(worker)
+			return
+		case <-idle:
+			fmt.Printf("All requests processed. %s has been idle for %s\n", worker.name, bucket.idleTimeout)
 		}
-
 	}
 }
 
 // workerPoolSizeAdjuster monitors the amount of requests on the bucket argument passed in
-// and scales the number of workers operating on it accordingly.
+// and scales the bucket's worker pool accordingly.
 // Workers are added if the bucket only has 10% of its capacity open for requests at a given time,
 // and if there is room to add more workers to a buckets pool.
 // Workers are removed if the bucket is using less than 10% of its capacity and there are more than 3 workers currently.
-func workerPoolSizeAdjuster(pool []worker, bucket leakyBucket) {
+// If criticalWait is set and the oldest queued request has waited longer than it, the pool is scaled
+// straight to workerCap in a single evaluation as a last resort against runaway latency.
+// The pool is evaluated once every scaleInterval rather than in a tight loop, so the adjuster
+// yields the processor to the workers and the request receiver between checks.
+// Each scaling action first waits for a permit from the bucket's scaleLimiter, if it has one.
+// The adjuster returns once the bucket has been shut down, its scale limiter has been stopped, or it
+// has been detached by handover. Only one adjuster runs on a bucket at a time.
+func workerPoolSizeAdjuster(bucket *leakyBucket) {
+	if !bucket.initialized() {
+		fmt.Printf("Unable to adjust the worker pool: %v\n", errNotInitialized)
+		return
+	}
+	if !bucket.adjusting.CompareAndSwap(false, true) {
+		fmt.Printf("The worker pool of %s already has an adjuster running\n", bucket.name)
+		return
+	}
+	bucket.goroutines.Add(1)
+	detached := bucket.adjustPool()
+	bucket.goroutines.Add(-1)
+	bucket.adjusting.Store(false)
+	// Acknowledging a handover is the very last step, so nothing this adjuster does can touch the
+	// bucket once the new owner has been told it may start its own.
+	if detached != nil {
+		close(detached)
+	}
+}
+
+// adjustPool runs the evaluation loop of workerPoolSizeAdjuster. It returns the channel a handover is
+// waiting to have closed if the adjuster was detached, or nil if it stopped for any other reason.
+func (bucket *leakyBucket) adjustPool() chan struct{} {
+	ticker := time.NewTicker(bucket.scaleInterval)
+	defer ticker.Stop()
 	for {
-		if len(bucket.requestChannel) > (cap(bucket.requestChannel)-(cap(bucket.requestChannel)/10)) && ((len(pool) + 1) <= bucket.workerCap) {
+		select {
+		case <-bucket.stopped:
+			return nil
+		case detached := <-bucket.detach:
+			return detached
+		case <-ticker.C:
+		}
+		bucket.relievePressure()
+		bucket.checkStall()
+		if bucket.warmupAcceptOnly && bucket.warmingUp() {
+			continue
+		}
+		zone := bucket.zone()
+		bucket.observeZone(zone)
+		// Wedged workers still hold a Go routine, so they count toward workerCap until they exit.
+		workers := bucket.workerCount() + bucket.wedgedCount()
+		if bucket.criticalWait > 0 && bucket.oldestWait() > bucket.criticalWait && workers < bucket.workerCap {
+			fmt.Printf("A request has waited longer than %s! Scaling straight to %d workers.\n", bucket.criticalWait, bucket.workerCap)
+			for ; workers < bucket.workerCap; workers++ {
+				if !bucket.scaleLimiter.acquire(bucket.stopped) {
+					return nil
+				}
+				spawnWorker(bucket)
+			}
+			bucket.recordScaleReaction()
+			continue
+		}
+		if zone == aboveHighWatermark && ((workers + 1) <= bucket.workerCap) {
+			if !bucket.scaleLimiter.acquire(bucket.stopped) {
+				return nil
+			}
 			fmt.Println("Additional worker being spawned to help process requests.")
-			newWorkerName := fmt.Sprintf("Worker %d", len(pool)+1)
-			newWorker := worker{name: newWorkerName, quitChannel: make(chan bool)}
-			pool = append(pool, newWorker)
-			go processRequests(newWorker, bucket)
-		} else if (len(bucket.requestChannel) < (cap(bucket.requestChannel) / 10)) && (len(pool)-1 >= bucket.workerMin) {
+			spawnWorker(bucket)
+			bucket.recordScaleReaction()
+		} else if zone == belowLowWatermark && (workers-1 >= bucket.workerMin) {
+			if !bucket.scaleLimiter.acquire(bucket.stopped) {
+				return nil
+			}
 			fmt.Println("Removing workers due to light request load.")
-			pool[len(pool)-1].quitChannel <- true
-			pool = pool[:len(pool)-1]
+			bucket.stopNewestWorker()
 		}
 	}
 }
 
-// initializeBucket initializes and returns a leakyBucket struct.
-func initializeBucket(bucketName string, bucketCapacity int, workerCap int, workerMin int) leakyBucket {
-	requests := make(chan request, bucketCapacity)
-	return leakyBucket{requestChannel: requests, name: bucketName, workerCap: workerCap, workerMin: workerMin}
+// handover detaches the worker pool size adjuster running on the bucket, returning once it has exited,
+// so a new owner, such as a restarted supervisor, can take over management by starting its own with
+// workerPoolSizeAdjuster. Only the adjuster changes hands: workers keep processing, queued and in-flight
+// requests are untouched, and intake stays open throughout, so no request is lost. The pool is simply not
+// resized until the new adjuster starts. It returns false if no adjuster was running or the bucket has
+// been shut down.
+func (bucket *leakyBucket) handover() bool {
+	detached := make(chan struct{})
+	for bucket.adjusting.Load() {
+		select {
+		case bucket.detach <- detached:
+			<-detached
+			return true
+		case <-bucket.stopped:
+			return false
+		case <-time.After(bucket.scaleInterval):
+			// The adjuster may have exited for another reason, so check it is still running.
+		}
+	}
+	return false
 }
 
-func main() {
-	// Create a bucket to simulate a rate limit that applies to all traffic coming into a server,
-	// regardless of origin or purpose.
-	globalBucket := initializeBucket("Global Bucket", 20, 5, 3)
+// selfTestRequestType is the request type of the synthetic request ready sends through the bucket.
+const selfTestRequestType = "Self Test"
+
+// ready checks the bucket end to end before it is sent traffic, by submitting a synthetic request of
+// selfTestRequestType and waiting for a worker to finish processing it. The request is processed like
+// any other, so the process function sees it too, but as a probe it is not counted by type, audited, or
+// passed to onComplete. It returns an error if the request is refused, or if ctx is done before it is
+// processed, such as when there are no workers or processing never finishes.
+func (bucket *leakyBucket) ready(ctx context.Context) error {
+	probe := make(chan struct{})
+	if err := bucket.tryAdd(request{requestType: selfTestRequestType, requestedAt: bucket.requestTime(), probe: probe}); err != nil {
+		return fmt.Errorf("self-test request was refused: %w", err)
+	}
+	select {
+	case <-probe:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("self-test request was not processed: %w", ctx.Err())
+	}
+}
+
+// initialized reports whether the bucket was created by initializeBucket and is safe to send
+// requests to and receive requests from.
+func (bucket *leakyBucket) initialized() bool {
+	return bucket.requestChannel != nil
+}
+
+// now returns the current time from the bucket's clock, falling back to time.Now for a bucket
+// that was not created by initializeBucket.
+func (bucket *leakyBucket) now() time.Time {
+	if bucket.clock == nil {
+		return time.Now()
+	}
+	return bucket.clock()
+}
+
+// since returns how long it has been since t according to the bucket's clock, clamped at zero.
+func (bucket *leakyBucket) since(t time.Time) time.Duration {
+	return elapsed(t, bucket.now())
+}
+
+// elapsed returns the duration from start to end, clamped at zero so that a clock stepping backwards,
+// such as from an NTP adjustment, never produces a negative age or latency.
+func elapsed(start time.Time, end time.Time) time.Duration {
+	if end.Before(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// requestTime returns the time new requests should be stamped with as their requestedAt.
+func (bucket *leakyBucket) requestTime() time.Time {
+	if bucket.timestampClock == nil {
+		return bucket.now()
+	}
+	return bucket.timestampClock()
+}
+
+// useCoarseClock stamps new requests from a coarseClock with the given resolution instead of calling
+// time.Now for each one. The clock is stopped when the bucket is shut down. It must be called before
+// any requests are added.
+func (bucket *leakyBucket) useCoarseClock(resolution time.Duration) {
+	bucket.coarse = newCoarseClock(resolution)
+	bucket.timestampClock = bucket.coarse.now
+}
+
+// spawnWorker adds a new worker to the bucket's pool and starts it processing requests.
+// The worker joins the pool before its Go routine starts, so it is counted immediately.
+// A Go routine parked in the warm pool takes the worker if one is waiting, otherwise a new one is started.
+// No worker is spawned once the bucket has been shut down.
+func spawnWorker(bucket *leakyBucket) {
+	bucket.mu.Lock()
+	spawned, ok := bucket.addWorkerLocked()
+	bucket.mu.Unlock()
+	if ok {
+		bucket.startWorker(spawned)
+	}
+}
+
+// addWorkerLocked creates a new worker and adds it to the pool, for a caller holding bucket.mu, returning
+// false if the bucket has been shut down. The worker does not run until it is passed to startWorker.
+func (bucket *leakyBucket) addWorkerLocked() (worker, bool) {
+	select {
+	case <-bucket.stopped:
+		return worker{}, false
+	default:
+	}
+	spawned := newWorker(fmt.Sprintf("Worker %d", bucket.workersRegistered+1))
+	bucket.workers = append(bucket.workers, spawned)
+	bucket.workersRegistered++
+	return spawned, true
+}
+
+// startWorker runs spawned, a worker already added to the pool by addWorkerLocked.
+func (bucket *leakyBucket) startWorker(spawned worker) {
+	spawned.spawnedAt = time.Now()
+	select {
+	case bucket.activations <- spawned:
+		return
+	default:
+	}
+	bucket.goWorker(spawned.name, func() { processRequests(spawned, bucket) })
+}
+
+// goWorker runs fn, which runs workers or feeds them requests, in a new Go routine started with the
+// bucket's launch function if it has one.
+func (bucket *leakyBucket) goWorker(name string, fn func()) {
+	if bucket.launch != nil {
+		bucket.launch(name, fn)
+		return
+	}
+	go fn()
+}
+
+// startWarmPool parks size Go routines ready to run newly spawned workers, so scaling up from idle
+// hands a worker to an already running Go routine instead of starting one. Each parked Go routine that
+// is activated is replaced by a new one, refilling the pool lazily. Parked Go routines are not workers:
+// they are not counted against workerCap until activated. It must be called before any workers are
+// spawned, and the parked Go routines exit once the bucket has been shut down.
+func (bucket *leakyBucket) startWarmPool(size int) {
+	bucket.activations = make(chan worker)
+	for i := 0; i < size; i++ {
+		bucket.goWorker("a parked worker", bucket.park)
+	}
+}
+
+// park waits in the warm pool until a spawned worker is handed to it, then runs the worker after
+// starting a replacement to keep the pool full. It returns without running a worker once the bucket
+// has been shut down.
+func (bucket *leakyBucket) park() {
+	bucket.parked.Add(1)
+	select {
+	case spawned := <-bucket.activations:
+		bucket.parked.Add(-1)
+		bucket.goWorker("a parked worker", bucket.park)
+		spawned.warm = true
+		processRequests(spawned, bucket)
+	case <-bucket.stopped:
+		bucket.parked.Add(-1)
+	}
+}
+
+// recordActivation records how long a spawned worker took from being started to entering processRequests,
+// and whether it was activated from the warm pool.
+func (bucket *leakyBucket) recordActivation(latency time.Duration, warm bool) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.activationLatency = latency
+	if warm {
+		bucket.warmActivations++
+	}
+}
+
+// tryAdd places req on the bucket if it can be admitted, returning an error describing why it was
+// refused otherwise. The decision is written to the admission log if one is set, and an admitted
+// request other than a ready probe is mirrored, as it was submitted, to the shadow bucket if one is set.
+func (bucket *leakyBucket) tryAdd(req request) error {
+	started := bucket.profile.start()
+	err := bucket.admit(req)
+	bucket.profile.finish(admissionOperation, started)
+	bucket.logAdmission(req, err)
+	if err == nil && bucket.shadow != nil && req.probe == nil {
+		bucket.shadow.tryAdd(req)
+	}
+	return err
+}
+
+// tryAddBatch offers each of reqs to the bucket in order, returning the outcome of each aligned with
+// reqs: nil for a request that was admitted, or the error it was refused with, which reasonCode turns
+// into a reason. Intake is held for the whole batch, so no other producer's requests are interleaved
+// with it. A batch larger than the room left is partially admitted: once a request is refused with
+// errBucketFull, every request after it is refused with errBucketFull too, even if a worker frees room in
+// the meantime, so the admitted requests are always taken from the front of the batch.
+func (bucket *leakyBucket) tryAddBatch(reqs []request) []error {
+	outcomes := make([]error, len(reqs))
+	if bucket.initialized() {
+		bucket.intake.Lock()
+		full := false
+		for i, req := range reqs {
+			if full {
+				bucket.recordDropped(1, errBucketFull)
+				outcomes[i] = errBucketFull
+				continue
+			}
+			outcomes[i] = bucket.admitLocked(req)
+			full = errors.Is(outcomes[i], errBucketFull)
+		}
+		bucket.intake.Unlock()
+	} else {
+		for i := range outcomes {
+			outcomes[i] = errNotInitialized
+		}
+	}
+	for i, req := range reqs {
+		bucket.logAdmission(req, outcomes[i])
+		if outcomes[i] == nil && bucket.shadow != nil {
+			bucket.shadow.tryAdd(req)
+		}
+	}
+	return outcomes
+}
+
+// admit places req on the bucket if it can be admitted, returning an error describing why it was refused otherwise.
+func (bucket *leakyBucket) admit(req request) error {
+	if !bucket.initialized() {
+		return errNotInitialized
+	}
+	bucket.intake.Lock()
+	defer bucket.intake.Unlock()
+	return bucket.admitLocked(req)
+}
+
+// admitLocked is admit for a caller already holding bucket.intake.
+func (bucket *leakyBucket) admitLocked(req request) error {
+	if bucket.shuttingDown {
+		bucket.recordDropped(1, errShutdown)
+		return errShutdown
+	}
+	if bucket.now().Before(bucket.pausedUntil) {
+		bucket.recordDropped(1, bucket.pausedFor)
+		return bucket.pausedFor
+	}
+	if !bucket.holdPaused && bucket.typePaused(req.requestType) {
+		bucket.recordDropped(1, errTypePaused)
+		return errTypePaused
+	}
+	if bucket.depth() >= bucket.capacity() {
+		bucket.recordDropped(1, errBucketFull)
+		return errBucketFull
+	}
+	if bucket.keyLimit > 0 && req.key != "" && bucket.queuedForKey(req.key) >= bucket.keyLimit {
+		bucket.recordDropped(1, errKeyLimit)
+		return errKeyLimit
+	}
+	if bucket.maxQueueWait > 0 && bucket.estimateWait() > bucket.maxQueueWait {
+		bucket.recordDropped(1, errWaitTooLong)
+		return errWaitTooLong
+	}
+	req.requestedAt = bucket.correctedTime(req)
+	req.skewCorrected = true
+	if bucket.onEnqueue != nil {
+		bucket.onEnqueue(&req)
+	}
+	bucket.enqueue(req)
+	return nil
+}
+
+// correctedTime returns when req was made according to the common baseline, removing the clock skew
+// configured for its source. Requests from sources without a configured skew, and requests already
+// corrected, are left as they are.
+func (bucket *leakyBucket) correctedTime(req request) time.Time {
+	if req.skewCorrected {
+		return req.requestedAt
+	}
+	return req.requestedAt.Add(-bucket.clockSkew[req.source])
+}
+
+// orderForReplay returns a copy of reqs sorted by when they were made according to the common baseline,
+// so requests captured from several sources with skewed clocks can be replayed in their true order.
+// Requests made at the same corrected time keep their relative order.
+func (bucket *leakyBucket) orderForReplay(reqs []request) []request {
+	ordered := make([]request, len(reqs))
+	copy(ordered, reqs)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return bucket.correctedTime(ordered[i]).Before(bucket.correctedTime(ordered[j]))
+	})
+	return ordered
+}
+
+// reasonCode returns the short reason code recorded for an admission decision that returned err.
+func reasonCode(err error) string {
+	switch {
+	case err == nil:
+		return "admitted"
+	case errors.Is(err, errBucketFull):
+		return "full"
+	case errors.Is(err, errWaitTooLong):
+		return "wait_too_long"
+	case errors.Is(err, errNotInitialized):
+		return "not_initialized"
+	case errors.Is(err, errShutdown):
+		return "shutdown"
+	case errors.Is(err, errSuperseded):
+		return "superseded"
+	case errors.Is(err, errMemoryPressure):
+		return "memory_pressure"
+	case errors.Is(err, errTypePaused):
+		return "type_paused"
+	case errors.Is(err, errKeyLimit):
+		return "key_limit"
+	case errors.Is(err, errStalled):
+		return "stalled"
+	default:
+		return "rejected"
+	}
+}
+
+// logAdmission writes the admission decision for req to the bucket's admission log, sampling decisions
+// at admissionSampleRate to control the log's volume.
+func (bucket *leakyBucket) logAdmission(req request, err error) {
+	if bucket.admissionLog == nil || rand.Float64() >= bucket.admissionSampleRate {
+		return
+	}
+	decision := "admitted"
+	if err != nil {
+		decision = "rejected"
+	}
+	bucket.admissionLogMu.Lock()
+	defer bucket.admissionLogMu.Unlock()
+	_, writeErr := fmt.Fprintf(bucket.admissionLog, "%s\t%s\t%s\t%s\t%s\n",
+		bucket.now().Format(time.RFC3339Nano), bucket.name, req.requestType, decision, reasonCode(err))
+	if writeErr != nil {
+		fmt.Printf("Unable to write admission record for %s: %v\n", bucket.name, writeErr)
+	}
+}
+
+// enqueue assigns req the next sequence number and places it on the bucket.
+// The caller must hold bucket.intake and have checked there is room for req.
+func (bucket *leakyBucket) enqueue(req request) {
+	defer bucket.profile.finish(enqueueOperation, bucket.profile.start())
+	req.sequence = bucket.admitted
+	if bucket.compactByKey && req.key != "" {
+		bucket.mu.Lock()
+		bucket.latestByKey[req.key] = req.sequence
+		bucket.mu.Unlock()
+	}
+	bucket.queuedAtMu.Lock()
+	bucket.admitted++
+	now := bucket.now()
+	bucket.queuedAt = append(bucket.queuedAt, now)
+	bucket.queuedTypes[req.requestType]++
+	if req.key != "" {
+		bucket.queuedKeys[req.key]++
+	}
+	if len(bucket.queuedAt) == bucket.capacity() && bucket.fullSince.IsZero() {
+		bucket.fullSince = now
+	}
+	if zoneOf(len(bucket.queuedAt), bucket.capacity()) == aboveHighWatermark && bucket.highSince.IsZero() {
+		bucket.highSince = now
+	}
+	depth := len(bucket.queuedAt)
+	bucket.queuedAtMu.Unlock()
+	bucket.recordArrival()
+	bucket.requestChannel <- req
+	bucket.checkAlerts(depth)
+}
+
+// dequeued records that req has been received from requestChannel, so it no longer counts toward how
+// long the oldest queued request has waited or toward the queue's composition. If processing is true,
+// the request is counted as in flight, and otherwise as having left, in the same step that it stops
+// counting as queued, so it is never briefly untracked.
+func (bucket *leakyBucket) dequeued(req request, processing bool) {
+	defer bucket.profile.finish(dequeueOperation, bucket.profile.start())
+	bucket.queuedAtMu.Lock()
+	if processing {
+		bucket.inFlight.Add(1)
+	} else {
+		bucket.left++
+	}
+	if len(bucket.queuedAt) > 0 {
+		bucket.queuedAt = bucket.queuedAt[1:]
+	}
+	if bucket.queuedTypes[req.requestType] > 1 {
+		bucket.queuedTypes[req.requestType]--
+	} else {
+		delete(bucket.queuedTypes, req.requestType)
+	}
+	if bucket.queuedKeys[req.key] > 1 {
+		bucket.queuedKeys[req.key]--
+	} else {
+		delete(bucket.queuedKeys, req.key)
+	}
+	if !bucket.fullSince.IsZero() {
+		now := bucket.now()
+		bucket.fullTotal += elapsed(bucket.fullSince, now)
+		bucket.fullPeriods = append(bucket.fullPeriods, timeSpan{start: bucket.fullSince, end: now})
+		bucket.fullSince = time.Time{}
+		bucket.pruneFullPeriods(now)
+	}
+	if zoneOf(len(bucket.queuedAt), bucket.capacity()) != aboveHighWatermark {
+		bucket.highSince = time.Time{}
+	}
+	depth := len(bucket.queuedAt)
+	bucket.queuedAtMu.Unlock()
+	bucket.signalDrained()
+	bucket.checkAlerts(depth)
+}
+
+// checkAlerts compares depth against the bucket's alert levels and calls onThreshold whenever the
+// active alert level changes, passing the new level's name, or "ok" once the depth falls below every
+// level. Alerts are edge triggered: a level fires once when the depth rises to it and is only cleared
+// once the depth falls alertHysteresis below it, so a depth hovering around a level does not flap.
+func (bucket *leakyBucket) checkAlerts(depth int) {
+	if bucket.onThreshold == nil || len(bucket.alertLevels) == 0 {
+		return
+	}
+	bucket.alertMu.Lock()
+	defer bucket.alertMu.Unlock()
+	fill := float64(depth) / float64(bucket.capacity())
+	active := bucket.activeAlert
+	for active < len(bucket.alertLevels) && fill >= bucket.alertLevels[active].fraction {
+		active++
+	}
+	for active > 0 && fill < bucket.alertLevels[active-1].fraction-bucket.alertHysteresis {
+		active--
+	}
+	if active == bucket.activeAlert {
+		return
+	}
+	bucket.activeAlert = active
+	level := "ok"
+	if active > 0 {
+		level = bucket.alertLevels[active-1].name
+	}
+	bucket.onThreshold(level, depth)
+}
+
+// pruneFullPeriods drops full periods that ended longer than completionHistory ago.
+// The caller must hold bucket.queuedAtMu.
+func (bucket *leakyBucket) pruneFullPeriods(now time.Time) {
+	kept := 0
+	for kept < len(bucket.fullPeriods) && elapsed(bucket.fullPeriods[kept].end, now) > bucket.completionHistory {
+		kept++
+	}
+	bucket.fullPeriods = bucket.fullPeriods[kept:]
+}
+
+// fullDuration returns the total time the bucket has spent completely full and dropping requests,
+// including the time spent in a full period still in progress.
+func (bucket *leakyBucket) fullDuration() time.Duration {
+	bucket.queuedAtMu.Lock()
+	defer bucket.queuedAtMu.Unlock()
+	total := bucket.fullTotal
+	if !bucket.fullSince.IsZero() {
+		total += bucket.since(bucket.fullSince)
+	}
+	return total
+}
+
+// fullRatio returns the fraction of the most recent window, from 0 to 1, the bucket spent completely full.
+// Full periods are only remembered for completionHistory, so longer windows under report the ratio.
+func (bucket *leakyBucket) fullRatio(window time.Duration) float64 {
+	if window <= 0 {
+		return 0
+	}
+	bucket.queuedAtMu.Lock()
+	defer bucket.queuedAtMu.Unlock()
+	now := bucket.now()
+	windowStart := now.Add(-window)
+	bucket.pruneFullPeriods(now)
+
+	periods := bucket.fullPeriods
+	if !bucket.fullSince.IsZero() {
+		periods = append(periods[:len(periods):len(periods)], timeSpan{start: bucket.fullSince, end: now})
+	}
+	var full time.Duration
+	for _, period := range periods {
+		start := period.start
+		if start.Before(windowStart) {
+			start = windowStart
+		}
+		full += elapsed(start, period.end)
+	}
+	return math.Min(full.Seconds()/window.Seconds(), 1)
+}
+
+// backlog returns how many requests are queued and how many are in flight, read together under queuedAtMu,
+// since requests move from one to the other under it. Unlike depth, queued counts a request from the moment
+// it is admitted until a worker has recorded taking it, including while it is on its way into or out of
+// the request channel.
+func (bucket *leakyBucket) backlog() (queued int, inFlight int64) {
+	bucket.queuedAtMu.Lock()
+	defer bucket.queuedAtMu.Unlock()
+	return len(bucket.queuedAt), bucket.inFlight.Load()
+}
+
+// quiesced reports whether the bucket is idle: nothing is queued, no requests are in flight, and the
+// worker pool size adjuster has no scale-down left to perform.
+func (bucket *leakyBucket) quiesced() bool {
+	if queued, inFlight := bucket.backlog(); queued > 0 || inFlight > 0 {
+		return false
+	}
+	return bucket.workerCount() <= bucket.workerMin
+}
+
+// recordScaleReaction records how long it took to scale up after the queue depth rose above the high
+// watermark. The reaction is then measured afresh from this scale up, so a pool that keeps scaling under
+// sustained load reports the time between each scaling action. Since the adjuster evaluates the pool
+// every scaleInterval, the reaction time stays within scaleInterval of the depth crossing the watermark.
+func (bucket *leakyBucket) recordScaleReaction() {
+	bucket.queuedAtMu.Lock()
+	now := bucket.now()
+	crossedAt := bucket.highSince
+	if !crossedAt.IsZero() {
+		bucket.highSince = now
+	}
+	bucket.queuedAtMu.Unlock()
+	if crossedAt.IsZero() {
+		return
+	}
+
+	reaction := elapsed(crossedAt, now)
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.scaleReaction = reaction
+	if reaction > bucket.maxScaleReaction {
+		bucket.maxScaleReaction = reaction
+	}
+}
+
+// oldestWait returns how long the oldest request still on the bucket has been waiting, or 0 if the
+// bucket is empty.
+func (bucket *leakyBucket) oldestWait() time.Duration {
+	bucket.queuedAtMu.Lock()
+	defer bucket.queuedAtMu.Unlock()
+	if len(bucket.queuedAt) == 0 {
+		return 0
+	}
+	return bucket.since(bucket.queuedAt[0])
+}
+
+// estimateWait estimates how long a request admitted now would wait before a worker picks it up,
+// assuming each active worker keeps taking requests off the bucket one at a time and spends
+// expectedServiceTime on each. A bucket with no active workers is estimated as if it had one.
+func (bucket *leakyBucket) estimateWait() time.Duration {
+	workers := bucket.workerCount()
+	if workers < 1 {
+		workers = 1
+	}
+	ahead := bucket.depth()
+	rounds := (ahead + workers - 1) / workers
+	return time.Duration(rounds) * bucket.expectedServiceTime("")
+}
+
+// worstCaseWait estimates how long the last admitted request of a burst of burst requests, arriving all at
+// once, would wait before a worker picks it up. It assumes the worst case for the current configuration:
+// the pool does not scale up during the burst, every worker has only just started a request of its own,
+// and each request takes expectedServiceTime. Requests in the burst beyond the bucket's free capacity would be
+// dropped, so they do not add to the wait. When pacing is enabled, the wait is at least the time the pacer
+// needs to start every request ahead of the last one.
+func (bucket *leakyBucket) worstCaseWait(burst int) time.Duration {
+	free := bucket.capacity() - bucket.depth()
+	if burst > free {
+		burst = free
+	}
+	if burst <= 0 {
+		return 0
+	}
+	workers := bucket.workerCount()
+	if workers < 1 {
+		workers = 1
+	}
+	ahead := bucket.depth() + burst - 1
+	wait := time.Duration(ahead/workers+1) * bucket.expectedServiceTime("")
+	if paced := time.Duration(ahead) * bucket.pace; paced > wait {
+		wait = paced
+	}
+	return wait
+}
+
+// depth returns how many requests are currently queued on the bucket. Code reporting or deciding on
+// the queue's depth should use it rather than reading the request channel directly, so it stays the
+// logical depth if requests ever stop mapping one to one onto channel slots.
+func (bucket *leakyBucket) depth() int {
+	return len(bucket.requestChannel)
+}
+
+// capacity returns how many requests the bucket can hold, the logical counterpart of depth.
+func (bucket *leakyBucket) capacity() int {
+	return cap(bucket.requestChannel)
+}
+
+// timeToEmpty estimates how long until the current backlog, both queued and in-flight requests, has fully
+// drained, assuming no more requests arrive and the pool stays its current size. Each worker is assumed to
+// finish a request every expectedServiceTime, and in-flight requests are counted as if they had only just
+// started. When the bucket is gated by its leak loop, the backlog drains no faster than the leak rate.
+// It returns 0 when the bucket is empty with nothing in flight.
+func (bucket *leakyBucket) timeToEmpty() time.Duration {
+	queued := bucket.depth()
+	inFlight := int(bucket.inFlight.Load())
+	if queued+inFlight == 0 {
+		return 0
+	}
+	workers := bucket.workerCount()
+	if workers < 1 {
+		workers = 1
+	}
+	serviceTime := bucket.expectedServiceTime("")
+	drain := time.Duration((queued+inFlight+workers-1)/workers) * serviceTime
+	if bucket.releases != nil {
+		if leaked := time.Duration(queued)*bucket.leakInterval + serviceTime; leaked > drain {
+			drain = leaked
+		}
+	}
+	return drain
+}
 
-	// Initialize a worker pool and add 3 workers to start.
-	workerPool := make([]worker, 0)
-	workerPool = append(workerPool, worker{name: "Worker 1", quitChannel: make(chan bool)})
-	workerPool = append(workerPool, worker{name: "Worker 2", quitChannel: make(chan bool)})
-	workerPool = append(workerPool, worker{name: "Worker 3", quitChannel: make(chan bool)})
+// headroom returns how many more requests the bucket can take before its queue reaches targetUtil, the
+// fraction of its capacity from 0 to 1 it should be kept below, such as 0.8. It is 0 once the queue is
+// at or above the target.
+func (bucket *leakyBucket) headroom(targetUtil float64) int {
+	target := int(math.Floor(targetUtil * float64(bucket.capacity())))
+	if remaining := target - bucket.depth(); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// activeGoroutines returns how many Go routines are currently managing the bucket: its producers,
+// workers, worker pool size adjuster, and leak loop. Go routines parked in the warm pool are not
+// counted until they are activated as workers.
+func (bucket *leakyBucket) activeGoroutines() int {
+	return int(bucket.goroutines.Load())
+}
+
+// workerCount returns the number of workers currently running on the bucket.
+func (bucket *leakyBucket) workerCount() int {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	return len(bucket.workers)
+}
+
+// registerWorker adds worker to the bucket's pool. A worker already in the pool, or one that has
+// already been asked to stop, is not added again, and a worker starting after the bucket has been
+// shut down is told to stop straight away.
+func (bucket *leakyBucket) registerWorker(worker worker) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	select {
+	case <-worker.quitChannel:
+		return
+	case <-bucket.stopped:
+		worker.stop()
+		return
+	default:
+	}
+	for _, running := range bucket.workers {
+		if running.done == worker.done {
+			return
+		}
+	}
+	bucket.workers = append(bucket.workers, worker)
+	bucket.workersRegistered++
+}
+
+// deregisterWorker removes worker from the bucket's pool, or from its wedged workers, if it is still in either.
+func (bucket *leakyBucket) deregisterWorker(worker worker) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	for i, running := range bucket.workers {
+		if running.done == worker.done {
+			bucket.workers = append(bucket.workers[:i], bucket.workers[i+1:]...)
+			return
+		}
+	}
+	for i, stuck := range bucket.wedged {
+		if stuck.done == worker.done {
+			bucket.wedged = append(bucket.wedged[:i], bucket.wedged[i+1:]...)
+			return
+		}
+	}
+}
+
+// retireWorker removes a worker reaching the end of its lifetime from the pool, first spawning a replacement
+// if its leaving would take the pool below workerMin. The replacement joins the pool under the same lock as the
+// worker leaves it, so workers retiring together cannot each count the other as still running and leave the
+// pool short.
+func (bucket *leakyBucket) retireWorker(retiring worker) {
+	bucket.mu.Lock()
+	var replacement worker
+	replace := false
+	for i, running := range bucket.workers {
+		if running.done == retiring.done {
+			if len(bucket.workers)-1 < bucket.workerMin {
+				replacement, replace = bucket.addWorkerLocked()
+			}
+			bucket.workers = append(bucket.workers[:i], bucket.workers[i+1:]...)
+			break
+		}
+	}
+	bucket.mu.Unlock()
+	if replace {
+		bucket.startWorker(replacement)
+	}
+}
+
+// wedgedCount returns how many workers the stall watchdog removed from the pool have not exited yet.
+func (bucket *leakyBucket) wedgedCount() int {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	return len(bucket.wedged)
+}
 
-	// Fill the bucket halfway full with requests to start.
-	// This is done just to showcase things more quickly in the demo.
-	for i := 0; i < cap(globalBucket.requestChannel)/2; i++ {
-		globalBucket.requestChannel <- request{requestType: "Login Attempt", requestedAt: time.Now()}
+// stopNewestWorker removes the most recently added worker from the bucket's pool and signals it to stop.
+// The worker leaves the pool straight away, so it is never counted or asked to stop again while it
+// finishes whatever it is doing.
+func (bucket *leakyBucket) stopNewestWorker() {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	if len(bucket.workers) == 0 {
+		return
 	}
+	newest := bucket.workers[len(bucket.workers)-1]
+	bucket.workers = bucket.workers[:len(bucket.workers)-1]
+	newest.stop()
+}
 
-	// Start simulating our leakyBucket receiving requests.
-	go receiveRequests(globalBucket)
+// broadcast delivers cmd to every worker running on the bucket and waits until each has received it.
+// A worker that stops before receiving the command is skipped rather than blocking the broadcast.
+// Workers pick up commands between requests, so a broadcast waits on any request in progress.
+func (bucket *leakyBucket) broadcast(cmd workerCommand) {
+	bucket.mu.Lock()
+	workers := make([]worker, len(bucket.workers))
+	copy(workers, bucket.workers)
+	bucket.mu.Unlock()
 
-	// Spawn a Go routine for each worker in our pool to start processing requests from our leakyBucket.
-	for _, item := range workerPool {
-		go processRequests(item, globalBucket)
+	var wg sync.WaitGroup
+	for _, running := range workers {
+		wg.Add(1)
+		go func(running worker) {
+			defer wg.Done()
+			select {
+			case running.commandChannel <- cmd:
+			case <-running.done:
+			}
+		}(running)
 	}
+	wg.Wait()
+}
 
-	// Spawn a Go routine to monitor and adjust the worker pool size dynamically.
-	go workerPoolSizeAdjuster(workerPool, globalBucket)
+// startLeakGate makes the leak loop the gate for processing: every interval it releases one queued request
+// to a waiting worker, so processing starts happen strictly at the leak rate however many workers are idle.
+// Requests released this way are processed one at a time regardless of batchSize. It must be called before
+// any workers are started, and the leak loop stops once the bucket has been shut down.
+func (bucket *leakyBucket) startLeakGate(interval time.Duration) {
+	bucket.leakInterval = interval
+	bucket.releases = make(chan struct{})
+	bucket.goWorker("the leak loop", func() { bucket.leak(interval) })
+}
 
-	// Empty infinite loop to allow the demo and Go routines to run.
+// leak releases one queued request to the workers every interval while the bucket is gated by startLeakGate.
+// The leak loop never takes requests off the bucket itself: a release only makes one request eligible, and
+// the worker that receives the release is what removes and processes it, so each request is consumed once.
+// Every interval the bucket sits empty saves up one extra release, up to leakBurst, which is spent as soon
+// as requests arrive so a bucket returning from idle drains a bounded burst in its first interval.
+// Intended to be run as a Go routine, it runs until the bucket has been shut down.
+func (bucket *leakyBucket) leak(interval time.Duration) {
+	bucket.goroutines.Add(1)
+	defer bucket.goroutines.Add(-1)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	saved := 0
 	for {
+		select {
+		case <-bucket.stopped:
+			return
+		case <-ticker.C:
+		}
+		queued := bucket.depth()
+		if queued == 0 {
+			if saved < bucket.leakBurst {
+				saved++
+			}
+			continue
+		}
+
+		release := 1 + saved
+		if release > queued {
+			release = queued
+		}
+		saved -= release - 1
+		for i := 0; i < release; i++ {
+			select {
+			case bucket.releases <- struct{}{}:
+			case <-bucket.stopped:
+				return
+			}
+		}
+	}
+}
+
+// shutdownAll shuts down buckets in dependency order, so a bucket that feeds requests into another, such as
+// a primary mirroring into its shadow, is drained before the bucket it feeds. Otherwise the downstream bucket
+// could stop while the upstream one was still sending it requests. An error is returned without shutting
+// anything down if the buckets feed one another in a cycle. If a bucket does not drain before ctx is done,
+// its error is returned and the buckets after it are left running.
+func shutdownAll(ctx context.Context, buckets []*leakyBucket) error {
+	included := make(map[*leakyBucket]bool, len(buckets))
+	for _, bucket := range buckets {
+		included[bucket] = true
+	}
+	upstream := make(map[*leakyBucket]int, len(buckets))
+	for _, bucket := range buckets {
+		if bucket.shadow != nil && included[bucket.shadow] {
+			upstream[bucket.shadow]++
+		}
+	}
+
+	order := make([]*leakyBucket, 0, len(buckets))
+	ready := make([]*leakyBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		if upstream[bucket] == 0 {
+			ready = append(ready, bucket)
+		}
+	}
+	for len(ready) > 0 {
+		bucket := ready[0]
+		ready = ready[1:]
+		order = append(order, bucket)
+		if downstream := bucket.shadow; downstream != nil && included[downstream] {
+			upstream[downstream]--
+			if upstream[downstream] == 0 {
+				ready = append(ready, downstream)
+			}
+		}
+	}
+	if len(order) < len(buckets) {
+		return errors.New("buckets feed one another in a cycle and cannot be shut down in order")
+	}
+
+	for _, bucket := range order {
+		if err := bucket.shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pause waits for d, returning false straight away if the bucket starts shutting down in the meantime
+// so that producers backing off a full bucket stop promptly rather than after their delay.
+func (bucket *leakyBucket) pause(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-bucket.closing:
+		return false
+	}
+}
+
+// shutdown stops the bucket gracefully. New requests are refused with errShutdown from the moment it is
+// called, while requests already admitted are left to drain, with any paused types resumed so held requests
+// drain too. Once nothing is queued or in flight, the worker pool size adjuster and every worker are stopped,
+// and shutdown returns after all the workers have exited. If ctx is done first, such as when no workers are
+// left to drain the queue, shutdown gives up waiting and returns an error wrapping ctx's error; intake stays
+// closed, and calling shutdown again resumes waiting.
+// Calling shutdown again, including concurrently, waits for the same drain, bounded by its own ctx.
+func (bucket *leakyBucket) shutdown(ctx context.Context) error {
+	if !bucket.initialized() {
+		return errNotInitialized
+	}
+	bucket.shutdownOnce.Do(func() {
+		bucket.intake.Lock()
+		bucket.shuttingDown = true
+		bucket.intake.Unlock()
+		close(bucket.closing)
+		bucket.resumeAllTypes()
+	})
+
+	for queued, inFlight := bucket.backlog(); queued > 0 || inFlight > 0; queued, inFlight = bucket.backlog() {
+		select {
+		case <-bucket.drained:
+		case <-ctx.Done():
+			return fmt.Errorf("%s did not drain with %d requests queued and %d in flight: %w",
+				bucket.name, queued, inFlight, ctx.Err())
+		}
+	}
+	// Only one wakeup is pending at a time, so pass it on to any concurrent shutdown still waiting.
+	bucket.signalDrained()
+	bucket.stopOnce.Do(func() {
+		close(bucket.stopped)
+		if bucket.coarse != nil {
+			bucket.coarse.stop()
+		}
+		bucket.mu.Lock()
+		bucket.stopping = bucket.workers
+		bucket.workers = nil
+		bucket.mu.Unlock()
+		for _, running := range bucket.stopping {
+			running.stop()
+		}
+	})
+	for _, running := range bucket.stopping {
+		select {
+		case <-running.done:
+		case <-ctx.Done():
+			return fmt.Errorf("%s drained but its workers did not exit: %w", bucket.name, ctx.Err())
+		}
+	}
+	return nil
+}
+
+// signalDrained wakes shutdown, if it is waiting, to check whether the bucket has drained.
+func (bucket *leakyBucket) signalDrained() {
+	select {
+	case bucket.drained <- struct{}{}:
+	default:
+	}
+}
+
+// prefill places count requests of the given type on the bucket, stopping once the bucket is full
+// rather than blocking. It returns how many requests were enqueued and how many were refused.
+// When prefillSpread is set, the requests are stamped evenly across that window before now, oldest first,
+// so they are queued in the order they appear to have arrived.
+func (bucket *leakyBucket) prefill(requestType string, count int) (enqueued int, refused int) {
+	now := bucket.requestTime()
+	for i := 0; i < count; i++ {
+		requestedAt := now
+		if bucket.prefillSpread > 0 {
+			requestedAt = now.Add(-bucket.prefillSpread * time.Duration(count-i) / time.Duration(count))
+		}
+		if bucket.tryAdd(request{requestType: requestType, requestedAt: requestedAt}) != nil {
+			return enqueued, count - enqueued
+		}
+		enqueued++
+	}
+	return enqueued, 0
+}
+
+// receiveChannel exposes the receive side of the bucket's request channel for callers that want to
+// drain it with their own consumer loop instead of the built-in workers. Requests taken this way
+// bypass the workers entirely, so they are not counted as processed, audited, or reported to
+// onComplete unless the caller does so itself with recordProcessed, audit, and complete.
+// Callers should also call dequeued for every request they receive, to keep wait tracking accurate:
+// dequeued(req, true) followed by recordProcessed for requests they process, or dequeued(req, false) for
+// requests they discard.
+func (bucket *leakyBucket) receiveChannel() <-chan request {
+	return bucket.requestChannel
+}
+
+// relievePressure sheds pressureShed of the queued requests, oldest first, and pauses intake for
+// pressurePause if memoryPressure reports the process is under memory pressure. Intake resumes once
+// the pause runs out, as long as the pressure has cleared by the time it is checked again.
+func (bucket *leakyBucket) relievePressure() {
+	if bucket.memoryPressure == nil || !bucket.memoryPressure() {
+		return
+	}
+	bucket.intake.Lock()
+	defer bucket.intake.Unlock()
+	bucket.pauseIntake(bucket.pressurePause, errMemoryPressure)
+
+	target := int(float64(bucket.depth()) * bucket.pressureShed)
+	shed := make([]request, 0, target)
+	for draining := target > 0; draining; {
+		select {
+		case req := <-bucket.requestChannel:
+			bucket.dequeued(req, false)
+			shed = append(shed, req)
+			draining = len(shed) < target
+		default:
+			draining = false
+		}
+	}
+	if len(shed) == 0 {
+		return
+	}
+	bucket.skipCompletions(shed)
+	bucket.recordLeft(len(shed))
+	bucket.queuedAtMu.Lock()
+	bucket.leftReasons[reasonCode(errMemoryPressure)] += uint64(len(shed))
+	bucket.queuedAtMu.Unlock()
+	fmt.Printf("%s is under memory pressure! Shedding %d requests and pausing intake for %s.\n", bucket.name, len(shed), bucket.pressurePause)
+}
+
+// pauseIntake refuses new requests with reason for the next duration. The caller must hold bucket.intake.
+func (bucket *leakyBucket) pauseIntake(duration time.Duration, reason error) {
+	bucket.pausedUntil = bucket.now().Add(duration)
+	bucket.pausedFor = reason
+}
+
+// maxStallBackoff is the most times the stall watchdog doubles stallWindow after stalls in a row.
+const maxStallBackoff = 6
+
+// checkStall is the worker pool watchdog. When no request has completed within stallWindow while the
+// oldest queued request has waited longer than it, the workers are assumed to be wedged, such as on a
+// deadlocked downstream. Every worker is then removed from the pool and told to stop, a fresh pool of at
+// least workerMin workers takes over the queue, and intake is paused for stallPause if it is set. A wedged
+// worker finishes whatever request it was stuck on if it ever comes unstuck, and then exits.
+// Wedged workers count against workerCap until they exit, so the replacements are cut short, or skipped
+// entirely, rather than running more than workerCap workers. Each stall in a row doubles the window
+// before the next one is detected, so a downstream that wedges every worker is not retried every window.
+func (bucket *leakyBucket) checkStall() {
+	if bucket.stallWindow <= 0 {
+		return
+	}
+	bucket.mu.Lock()
+	backoff := bucket.stalls
+	if backoff > maxStallBackoff {
+		backoff = maxStallBackoff
+	}
+	window := bucket.stallWindow << backoff
+	if bucket.since(bucket.lastProgress) <= window || bucket.oldestWait() <= window {
+		bucket.mu.Unlock()
+		return
+	}
+	stuck := bucket.workers
+	bucket.workers = nil
+	bucket.wedged = append(bucket.wedged, stuck...)
+	bucket.stalls++
+	bucket.lastProgress = bucket.now()
+	replacements := len(stuck)
+	if replacements < bucket.workerMin {
+		replacements = bucket.workerMin
+	}
+	if room := bucket.workerCap - len(bucket.wedged); replacements > room {
+		replacements = room
+	}
+	wedged := len(bucket.wedged)
+	bucket.mu.Unlock()
+
+	fmt.Printf("No requests completed on %s for %s! Stopping %d workers.\n", bucket.name, window, len(stuck))
+	for _, worker := range stuck {
+		worker.stop()
+	}
+	if replacements > 0 {
+		fmt.Printf("Spawning %d replacement workers on %s.\n", replacements, bucket.name)
+	} else {
+		fmt.Printf("%s already has %d wedged workers, so no replacements are spawned until they exit.\n", bucket.name, wedged)
+	}
+	for i := 0; i < replacements; i++ {
+		spawnWorker(bucket)
+	}
+	if bucket.stallPause > 0 {
+		bucket.intake.Lock()
+		bucket.pauseIntake(bucket.stallPause, errStalled)
+		bucket.intake.Unlock()
+	}
+}
+
+// extract removes every request waiting on the bucket and returns them, oldest first, emptying the
+// bucket so they can be inspected or processed offline. It is a swap with an empty queue, so no request
+// admitted concurrently is lost or handed out twice: each is either extracted or left on the bucket.
+// Extracted requests can be put back with swapQueue or tryAdd.
+func (bucket *leakyBucket) extract() []request {
+	return bucket.swapQueue(nil)
+}
+
+// swapQueue replaces the requests waiting on the bucket with reqs and returns the requests it replaced.
+// Intake is held for the duration of the swap so no new requests interleave with the installed ones.
+// Workers may keep pulling requests off the bucket while the swap happens; a request they take before
+// it is drained is processed as normal and is not part of the returned slice, so no request is lost
+// or handed out twice. Any of reqs that do not fit within the bucket's capacity are dropped.
+// A bucket that was never initialized has nothing to replace, so swapQueue installs nothing and returns nil.
+func (bucket *leakyBucket) swapQueue(reqs []request) []request {
+	if !bucket.initialized() {
+		fmt.Printf("Unable to swap the queue of %s: %v\n", bucket.name, errNotInitialized)
+		return nil
+	}
+	bucket.intake.Lock()
+	defer bucket.intake.Unlock()
+
+	previous := make([]request, 0, bucket.depth())
+	for draining := true; draining; {
+		select {
+		case req := <-bucket.requestChannel:
+			bucket.dequeued(req, false)
+			previous = append(previous, req)
+		default:
+			draining = false
+		}
+	}
+	bucket.skipCompletions(previous)
+	bucket.recordLeft(len(previous))
+
+	installed := 0
+	for _, req := range reqs {
+		if bucket.depth() >= bucket.capacity() {
+			break
+		}
+		bucket.enqueue(req)
+		installed++
+	}
+	if dropped := len(reqs) - installed; dropped > 0 {
+		bucket.recordDropped(dropped, errBucketFull)
+		fmt.Printf("Swapped queue exceeds capacity of %s! Dropping %d requests.\n", bucket.name, dropped)
+	}
+	return previous
+}
+
+// processBatch has worker process a batch of requests it has taken off the bucket and records the
+// outcome. The process function is loaded once per batch, so a batch that is already underway finishes
+// with the function it started with even if setProcess swaps it part way through.
+func (bucket *leakyBucket) processBatch(worker worker, batch []request) {
+	batch = bucket.holdPausedTypes(bucket.compact(batch))
+	if len(batch) == 0 {
+		return
+	}
+	process := bucket.process.Load()
+	floor := time.Duration(len(batch)) * bucket.minProcessingTime
+	bucket.awaitPace()
+	startedAt := bucket.now()
+	started := bucket.profile.start()
+	if len(batch) == 1 {
+		fmt.Printf("%s is processing a request of type %s\n", worker.name, batch[0].requestType)
+	} else {
+		fmt.Printf("%s is processing a batch of %d requests\n", worker.name, len(batch))
+	}
+	switch {
+	case bucket.dryRun:
+		for _, req := range batch {
+			if bucket.validate == nil {
+				continue
+			}
+			if err := bucket.validate(req); err != nil {
+				fmt.Printf("%s found an invalid request of type %s: %v\n", worker.name, req.requestType, err)
+			}
+		}
+	case process == nil:
+		slept := time.Now()
+		duration := bucket.serviceTime(batch[0])
+		if duration < floor {
+			duration = floor
+		}
+		time.Sleep(duration)
+		for _, req := range batch {
+			bucket.observeServiceTime(req.requestType, time.Since(slept)/time.Duration(len(batch)))
+		}
+	default:
+		called := time.Now()
+		(*process)(batch)
+		// A process function quicker than the floor is made up to it, as if the overhead had been paid.
+		time.Sleep(floor - time.Since(called))
+		for _, req := range batch {
+			bucket.observeServiceTime(req.requestType, time.Since(called)/time.Duration(len(batch)))
+		}
+	}
+	bucket.profile.finish(processOperation, started)
+	bucket.recordTrace(worker, batch, startedAt, bucket.now())
+	for _, processed := range batch {
+		bucket.recordProcessed(processed)
+		if processed.probe != nil {
+			bucket.skipCompletions([]request{processed})
+			close(processed.probe)
+			continue
+		}
+		bucket.audit(worker.name, processed)
+		bucket.complete(processed)
+	}
+}
+
+// pauseType pauses requests of requestType while other types keep flowing. Until resumeType is called,
+// they are refused at admission, or when the bucket holds paused types, set aside as workers dequeue them.
+// Once shutdown has started, pausing is refused with errShutdown, since shutdown resumes every paused type
+// so that held requests can drain, and pausing one again would leave the drain waiting on it forever.
+func (bucket *leakyBucket) pauseType(requestType string) error {
+	if !bucket.initialized() {
+		return errNotInitialized
+	}
+	bucket.intake.Lock()
+	defer bucket.intake.Unlock()
+	if bucket.shuttingDown {
+		return errShutdown
+	}
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.pausedTypes[requestType] = true
+	return nil
+}
+
+// resumeType resumes requests of requestType paused by pauseType. Requests of the type that were held
+// are handed back to the workers, in the order they were held.
+func (bucket *leakyBucket) resumeType(requestType string) {
+	bucket.mu.Lock()
+	delete(bucket.pausedTypes, requestType)
+	remaining := bucket.held[:0]
+	resumed := make([]request, 0)
+	for _, req := range bucket.held {
+		if req.requestType == requestType {
+			resumed = append(resumed, req)
+		} else {
+			remaining = append(remaining, req)
+		}
+	}
+	bucket.held = remaining
+	bucket.mu.Unlock()
+	bucket.deliverResumed(resumed)
+}
+
+// resumeAllTypes resumes every paused request type, handing every held request back to the workers.
+func (bucket *leakyBucket) resumeAllTypes() {
+	bucket.mu.Lock()
+	bucket.pausedTypes = make(map[string]bool)
+	resumed := bucket.held
+	bucket.held = nil
+	bucket.mu.Unlock()
+	bucket.deliverResumed(resumed)
+}
+
+// deliverResumed hands resumed requests to the workers from a separate Go routine, so resuming never
+// waits for a worker to become free.
+func (bucket *leakyBucket) deliverResumed(resumed []request) {
+	if len(resumed) == 0 {
+		return
+	}
+	bucket.goWorker("resumed request delivery", func() {
+		for _, req := range resumed {
+			bucket.resumed <- req
+		}
+	})
+}
+
+// typePaused reports whether requestType has been paused by pauseType.
+func (bucket *leakyBucket) typePaused(requestType string) bool {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	return bucket.pausedTypes[requestType]
+}
+
+// holdPausedTypes sets aside the requests in batch whose type is paused when the bucket holds paused
+// types, returning the requests still to be processed. Held requests stay in flight until resumed.
+func (bucket *leakyBucket) holdPausedTypes(batch []request) []request {
+	if !bucket.holdPaused {
+		return batch
+	}
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	live := make([]request, 0, len(batch))
+	for _, req := range batch {
+		if bucket.pausedTypes[req.requestType] {
+			bucket.held = append(bucket.held, req)
+		} else {
+			live = append(live, req)
+		}
+	}
+	return live
+}
+
+// compact discards requests in batch that have been superseded by a later request with the same key
+// when the bucket compacts by key, returning the requests still to be processed. Discarded requests
+// are counted as having left the bucket as superseded, not as dropped, and are no longer in flight.
+func (bucket *leakyBucket) compact(batch []request) []request {
+	if !bucket.compactByKey {
+		return batch
+	}
+	live := make([]request, 0, len(batch))
+	superseded := make([]request, 0)
+	bucket.mu.Lock()
+	for _, req := range batch {
+		latest, ok := bucket.latestByKey[req.key]
+		switch {
+		case req.key == "" || !ok:
+			live = append(live, req)
+		case latest == req.sequence:
+			delete(bucket.latestByKey, req.key)
+			live = append(live, req)
+		default:
+			superseded = append(superseded, req)
+		}
+	}
+	bucket.mu.Unlock()
+
+	if len(superseded) > 0 {
+		bucket.recordLeft(len(superseded))
+		bucket.skipCompletions(superseded)
+		bucket.queuedAtMu.Lock()
+		bucket.inFlight.Add(-int64(len(superseded)))
+		bucket.left += uint64(len(superseded))
+		bucket.leftReasons[reasonCode(errSuperseded)] += uint64(len(superseded))
+		bucket.queuedAtMu.Unlock()
+		bucket.signalDrained()
+	}
+	return live
+}
+
+// setProcess replaces the function workers use to process each batch of requests. Batches already being
+// processed finish with the previous function, while batches dequeued afterwards use fn.
+// Passing nil restores the default of simulating work by sleeping for serviceTime per batch.
+func (bucket *leakyBucket) setProcess(fn processFunc) {
+	if fn == nil {
+		bucket.process.Store(nil)
+		return
+	}
+	bucket.process.Store(&fn)
+}
+
+// fillBatch gathers up to batchSize requests starting with first, waiting at most batchWait for more
+// requests to arrive. When the bucket is nearly empty a smaller batch is returned rather than holding
+// on to the requests already gathered.
+func (bucket *leakyBucket) fillBatch(first request) []request {
+	batch := []request{first}
+	if bucket.batchSize <= 1 {
+		return batch
+	}
+	timer := time.NewTimer(bucket.batchWait)
+	defer timer.Stop()
+	for len(batch) < bucket.batchSize {
+		select {
+		case req := <-bucket.requestChannel:
+			bucket.dequeued(req, true)
+			batch = append(batch, req)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// awaitPace blocks until the pacer allows another request to start processing, reserving that start
+// for the caller. A worker waits here holding the request it has already taken off the bucket.
+func (bucket *leakyBucket) awaitPace() {
+	if bucket.pace <= 0 {
+		return
+	}
+	bucket.mu.Lock()
+	now := bucket.now()
+	start := bucket.nextStart
+	if start.Before(now) {
+		start = now
+	}
+	bucket.nextStart = start.Add(bucket.pace)
+	bucket.mu.Unlock()
+	time.Sleep(elapsed(now, start))
+}
+
+// serviceTime returns how long a worker should spend processing req, never less than minProcessingTime.
+// It is drawn from thinkTime when one is set, and is processingTime otherwise.
+func (bucket *leakyBucket) serviceTime(req request) time.Duration {
+	duration := bucket.processingTime
+	if bucket.thinkTime != nil {
+		bucket.rngMu.Lock()
+		duration = bucket.thinkTime.sample(bucket.rng)
+		bucket.rngMu.Unlock()
+	}
+	if duration < bucket.minProcessingTime {
+		return bucket.minProcessingTime
+	}
+	return duration
+}
+
+// meanServiceTime returns how long a worker spends processing a request on average, never less than
+// minProcessingTime. It is the mean of thinkTime when one is set, and is processingTime otherwise.
+func (bucket *leakyBucket) meanServiceTime() time.Duration {
+	duration := bucket.processingTime
+	if bucket.thinkTime != nil {
+		duration = bucket.thinkTime.mean()
+	}
+	if duration < bucket.minProcessingTime {
+		return bucket.minProcessingTime
+	}
+	return duration
+}
+
+// seedRandom reseeds the random source think times are drawn from, so a simulation can be reproduced.
+func (bucket *leakyBucket) seedRandom(seed int64) {
+	bucket.rngMu.Lock()
+	defer bucket.rngMu.Unlock()
+	bucket.rng = rand.New(rand.NewSource(seed))
+}
+
+// expectedServiceTime returns how long a request of requestType is expected to take to process, or any
+// request when requestType is empty. While estimating online this is the estimate built from observed
+// completions, and otherwise, or before any completions are observed, it is meanServiceTime.
+func (bucket *leakyBucket) expectedServiceTime(requestType string) time.Duration {
+	if bucket.estimateWeight <= 0 {
+		return bucket.meanServiceTime()
+	}
+	bucket.mu.Lock()
+	estimate, ok := bucket.observedTimes[requestType]
+	bucket.mu.Unlock()
+	if !ok {
+		return bucket.meanServiceTime()
+	}
+	return estimate
+}
+
+// observeServiceTime moves the processing time estimates for requestType, and for all request types,
+// toward took, the time a request of that type was just observed to take. Estimates start from
+// meanServiceTime, so they converge on the observed times over several completions. Nothing is recorded
+// unless the bucket is estimating online.
+func (bucket *leakyBucket) observeServiceTime(requestType string, took time.Duration) {
+	if bucket.estimateWeight <= 0 {
+		return
+	}
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	for _, estimated := range []string{requestType, ""} {
+		estimate, ok := bucket.observedTimes[estimated]
+		if !ok {
+			estimate = bucket.meanServiceTime()
+		}
+		bucket.observedTimes[estimated] = estimate + time.Duration(bucket.estimateWeight*float64(took-estimate))
+		if requestType == "" {
+			break
+		}
+	}
+}
+
+// zone returns the watermark zone the bucket's current queue depth falls in.
+// The watermarks are the same ones the worker pool size adjuster scales on.
+func (bucket *leakyBucket) zone() depthZone {
+	return zoneOf(bucket.depth(), bucket.capacity())
+}
+
+// zoneOf returns the watermark zone a queue depth falls in for a bucket of the given capacity.
+func zoneOf(depth int, capacity int) depthZone {
+	switch {
+	case depth > capacity-(capacity/10):
+		return aboveHighWatermark
+	case depth < capacity/10:
+		return belowLowWatermark
+	default:
+		return betweenWatermarks
+	}
+}
+
+// observeZone records a watermark crossing whenever the queue depth moves into a different zone
+// than the one last observed, discarding crossings that have fallen outside the oscillation window.
+func (bucket *leakyBucket) observeZone(zone depthZone) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	now := bucket.now()
+	if zone != bucket.lastZone {
+		bucket.watermarkCrossings = append(bucket.watermarkCrossings, now)
+		bucket.lastZone = zone
+	}
+	bucket.pruneCrossings(now)
+}
+
+// pruneCrossings drops recorded watermark crossings older than the oscillation window.
+// The caller must hold bucket.mu.
+func (bucket *leakyBucket) pruneCrossings(now time.Time) {
+	kept := bucket.watermarkCrossings[:0]
+	for _, crossedAt := range bucket.watermarkCrossings {
+		if elapsed(crossedAt, now) <= bucket.oscillationWindow {
+			kept = append(kept, crossedAt)
+		}
+	}
+	bucket.watermarkCrossings = kept
+}
+
+// oscillation returns how many times the queue depth crossed a scaling watermark within the
+// oscillation window. A steadily loaded bucket stays low, while a high value means the depth is
+// flapping back and forth across the watermarks and the thresholds may need tuning.
+func (bucket *leakyBucket) oscillation() int {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.pruneCrossings(bucket.now())
+	return len(bucket.watermarkCrossings)
+}
+
+// warmingUp reports whether the bucket is still within its warmup period.
+func (bucket *leakyBucket) warmingUp() bool {
+	return bucket.since(bucket.createdAt) < bucket.warmup
+}
+
+// recordProcessed updates the bucket's processing counters once a worker has finished a request.
+func (bucket *leakyBucket) recordProcessed(req request) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	now := bucket.now()
+	bucket.rollInterval(now)
+	bucket.completedAt = append(bucket.completedAt, now)
+	bucket.pruneCompletions(now)
+	bucket.processed++
+	bucket.inFlight.Add(-1)
+	bucket.lastProgress = now
+	bucket.stalls = 0
+	bucket.signalDrained()
+	bucket.currentInterval.processed++
+	if req.probe == nil {
+		bucket.processedTypes[req.requestType]++
+	}
+	bucket.changeInSystem(-1, now)
+	bucket.timeInSystem += elapsed(req.requestedAt, now)
+}
+
+// recordArrival counts a request entering the bucket toward its Little's Law metrics.
+func (bucket *leakyBucket) recordArrival() {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.arrivals++
+	bucket.changeInSystem(1, bucket.now())
+}
+
+// recordLeft counts requests that left the bucket without being processed, such as those removed by
+// swapQueue, so they no longer count as being in the system.
+func (bucket *leakyBucket) recordLeft(count int) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.changeInSystem(-count, bucket.now())
+}
+
+// changeInSystem adjusts the number of requests in the system by delta at now, first accumulating how
+// long the previous number was held for so the time averaged number in the system can be computed.
+// The caller must hold bucket.mu.
+func (bucket *leakyBucket) changeInSystem(delta int, now time.Time) {
+	bucket.inSystemArea += float64(bucket.inSystem) * elapsed(bucket.inSystemSince, now).Seconds()
+	bucket.inSystemSince = now
+	bucket.inSystem += delta
+}
+
+// littlesLaw reports the quantities in Little's Law, L = λW, averaged over the bucket's lifetime:
+// L is the average number of requests in the system, queued or being processed, λ is the arrival rate
+// in requests per second, and W is the average time in seconds a processed request spent in the system,
+// measured from its requestedAt. Under steady load L should come out close to lambda * W.
+func (bucket *leakyBucket) littlesLaw() (L, lambda, W float64) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	now := bucket.now()
+	bucket.changeInSystem(0, now)
+	lifetime := elapsed(bucket.createdAt, now).Seconds()
+	if lifetime > 0 {
+		L = bucket.inSystemArea / lifetime
+		lambda = float64(bucket.arrivals) / lifetime
+	}
+	if bucket.processed > 0 {
+		W = bucket.timeInSystem.Seconds() / float64(bucket.processed)
+	}
+	return L, lambda, W
+}
+
+// audit appends a record of req being processed by workerName to the bucket's audit writer, if one is set.
+func (bucket *leakyBucket) audit(workerName string, req request) {
+	if bucket.auditWriter == nil {
+		return
+	}
+	bucket.auditMu.Lock()
+	defer bucket.auditMu.Unlock()
+	_, err := fmt.Fprintf(bucket.auditWriter, "%s\t%s\t%s\t%s\n",
+		bucket.now().Format(time.RFC3339Nano), workerName, req.requestType, req.requestedAt.Format(time.RFC3339Nano))
+	if err != nil {
+		fmt.Printf("Unable to write audit record for %s: %v\n", bucket.name, err)
+	}
+}
+
+// complete reports req to onComplete once it has been processed. With orderedCompletions, req is held
+// in the reorder buffer until every request admitted before it has completed or been skipped.
+func (bucket *leakyBucket) complete(req request) {
+	if bucket.onComplete == nil {
+		return
+	}
+	bucket.completionMu.Lock()
+	defer bucket.completionMu.Unlock()
+	if !bucket.orderedCompletions {
+		bucket.onComplete(req)
+		return
+	}
+	bucket.pendingCompletions[req.sequence] = &req
+	bucket.releaseCompletions()
+}
+
+// skipCompletions marks reqs as having left the bucket without being processed, so the reorder buffer
+// does not wait on them forever.
+func (bucket *leakyBucket) skipCompletions(reqs []request) {
+	if bucket.onComplete == nil || !bucket.orderedCompletions {
+		return
+	}
+	bucket.completionMu.Lock()
+	defer bucket.completionMu.Unlock()
+	for _, req := range reqs {
+		bucket.pendingCompletions[req.sequence] = nil
+	}
+	bucket.releaseCompletions()
+}
+
+// releaseCompletions calls onComplete for every buffered completion that is next in sequence.
+// The caller must hold bucket.completionMu.
+func (bucket *leakyBucket) releaseCompletions() {
+	for {
+		req, ok := bucket.pendingCompletions[bucket.nextCompletion]
+		if !ok {
+			return
+		}
+		delete(bucket.pendingCompletions, bucket.nextCompletion)
+		bucket.nextCompletion++
+		if req != nil {
+			bucket.onComplete(*req)
+		}
+	}
+}
+
+// pruneCompletions drops completion times older than the completion history.
+// The caller must hold bucket.mu.
+func (bucket *leakyBucket) pruneCompletions(now time.Time) {
+	kept := 0
+	for kept < len(bucket.completedAt) && elapsed(bucket.completedAt[kept], now) > bucket.completionHistory {
+		kept++
+	}
+	bucket.completedAt = bucket.completedAt[kept:]
+}
+
+// serviceRate returns the number of requests per second the worker pool completed over the most
+// recent window. Comparing it against the arrival rate shows whether the pool is keeping up.
+// Completions are only remembered for completionHistory, so longer windows under report the rate.
+func (bucket *leakyBucket) serviceRate(window time.Duration) float64 {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	return bucket.completionRate(window)
+}
+
+// completionRate returns the requests per second completed over the most recent window.
+// The caller must hold bucket.mu.
+func (bucket *leakyBucket) completionRate(window time.Duration) float64 {
+	if window <= 0 {
+		return 0
+	}
+	now := bucket.now()
+	bucket.pruneCompletions(now)
+	completions := 0
+	for _, completedAt := range bucket.completedAt {
+		if elapsed(completedAt, now) <= window {
+			completions++
+		}
+	}
+	return float64(completions) / window.Seconds()
+}
+
+// recordDropped updates the bucket's drop counters when count requests are refused with err.
+func (bucket *leakyBucket) recordDropped(count int, err error) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.rollInterval(bucket.now())
+	bucket.dropped += uint64(count)
+	bucket.currentInterval.dropped += uint64(count)
+	bucket.droppedReasons[reasonCode(err)] += uint64(count)
+}
+
+// dropsByReason returns a snapshot of how many requests have been dropped for each reason code,
+// such as "full" or "wait_too_long". The returned map is a copy and is safe for the caller to modify.
+func (bucket *leakyBucket) dropsByReason() map[string]uint64 {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	counts := make(map[string]uint64, len(bucket.droppedReasons))
+	for reason, count := range bucket.droppedReasons {
+		counts[reason] = count
+	}
+	return counts
+}
+
+// leftByReason returns a snapshot of how many admitted requests the bucket has discarded without processing
+// for each reason code, such as "superseded". The returned map is a copy and is safe for the caller to modify.
+func (bucket *leakyBucket) leftByReason() map[string]uint64 {
+	bucket.queuedAtMu.Lock()
+	defer bucket.queuedAtMu.Unlock()
+	counts := make(map[string]uint64, len(bucket.leftReasons))
+	for reason, count := range bucket.leftReasons {
+		counts[reason] = count
+	}
+	return counts
+}
+
+// rollInterval closes out the current stats interval if now falls past its end, making it the last
+// completed interval. If whole intervals passed with no activity, the last completed interval is empty.
+// The caller must hold bucket.mu.
+func (bucket *leakyBucket) rollInterval(now time.Time) {
+	if bucket.statsInterval <= 0 {
+		return
+	}
+	sinceStart := elapsed(bucket.currentInterval.start, now)
+	if sinceStart < bucket.statsInterval {
+		return
+	}
+	completed := sinceStart / bucket.statsInterval
+	if completed == 1 {
+		bucket.lastInterval = bucket.currentInterval
+	} else {
+		bucket.lastInterval = intervalStats{start: bucket.currentInterval.start.Add((completed - 1) * bucket.statsInterval)}
+	}
+	bucket.currentInterval = intervalStats{start: bucket.currentInterval.start.Add(completed * bucket.statsInterval)}
+}
+
+// intervalStats returns the processed and dropped totals for the most recently completed stats interval.
+func (bucket *leakyBucket) intervalStats() intervalStats {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.rollInterval(bucket.now())
+	return bucket.lastInterval
+}
+
+// queueComposition returns a snapshot of how many requests of each type are currently queued on the
+// bucket. The counts are kept up to date as requests are enqueued and dequeued, so reading them does not
+// walk the queue. The returned map is a copy and is safe for the caller to read or modify.
+func (bucket *leakyBucket) queueComposition() map[string]int {
+	bucket.queuedAtMu.Lock()
+	defer bucket.queuedAtMu.Unlock()
+	counts := make(map[string]int, len(bucket.queuedTypes))
+	for requestType, count := range bucket.queuedTypes {
+		counts[requestType] = count
+	}
+	return counts
+}
+
+// queuedForKey returns how many requests with key are currently queued on the bucket.
+func (bucket *leakyBucket) queuedForKey(key string) int {
+	bucket.queuedAtMu.Lock()
+	defer bucket.queuedAtMu.Unlock()
+	return bucket.queuedKeys[key]
+}
+
+// queuedByKey returns a snapshot of how many requests with each key are currently queued on the bucket,
+// for spotting keys that are close to their keyLimit. Requests without a key are left out.
+// The returned map is a copy and is safe for the caller to read or modify.
+func (bucket *leakyBucket) queuedByKey() map[string]int {
+	bucket.queuedAtMu.Lock()
+	defer bucket.queuedAtMu.Unlock()
+	counts := make(map[string]int, len(bucket.queuedKeys))
+	for key, count := range bucket.queuedKeys {
+		counts[key] = count
+	}
+	return counts
+}
+
+// processedByType returns a snapshot of how many requests of each type have been processed.
+// The returned map is a copy and is safe for the caller to read or modify.
+func (bucket *leakyBucket) processedByType() map[string]uint64 {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	counts := make(map[string]uint64, len(bucket.processedTypes))
+	for requestType, count := range bucket.processedTypes {
+		counts[requestType] = count
+	}
+	return counts
+}
+
+// stats returns a summary of the bucket's current queue depth, workers, and cumulative counters.
+// The counters and the queue are both locked while the summary is taken, and every request moves between
+// queued, in flight, processed, and left under one of those locks, so admitted always equals depth plus
+// inFlight, processed, and left, and totals such as dropped always match their breakdowns. Intake is not
+// locked, so stats can be called from onEnqueue and onThreshold callbacks.
+func (bucket *leakyBucket) stats() bucketStats {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.queuedAtMu.Lock()
+	defer bucket.queuedAtMu.Unlock()
+	dropsByReason := make(map[string]uint64, len(bucket.droppedReasons))
+	for reason, count := range bucket.droppedReasons {
+		dropsByReason[reason] = count
+	}
+	leftByReason := make(map[string]uint64, len(bucket.leftReasons))
+	for reason, count := range bucket.leftReasons {
+		leftByReason[reason] = count
+	}
+	var serviceRate float64
+	if bucket.statsInterval > 0 {
+		bucket.rollInterval(bucket.now())
+		serviceRate = float64(bucket.lastInterval.processed) / bucket.statsInterval.Seconds()
+	}
+	return bucketStats{
+		name:              bucket.name,
+		serviceRate:       serviceRate,
+		dropsByReason:     dropsByReason,
+		leftByReason:      leftByReason,
+		depth:             len(bucket.queuedAt),
+		admitted:          bucket.admitted,
+		inFlight:          bucket.inFlight.Load(),
+		capacity:          bucket.capacity(),
+		workers:           len(bucket.workers),
+		processed:         bucket.processed,
+		left:              bucket.left,
+		dropped:           bucket.dropped,
+		scaleReaction:     bucket.scaleReaction,
+		maxScaleReaction:  bucket.maxScaleReaction,
+		warmPool:          int(bucket.parked.Load()),
+		warmActivations:   bucket.warmActivations,
+		activationLatency: bucket.activationLatency,
+		policy:            bucket.policy,
+	}
+}
+
+// String renders the stats as an aligned, human-readable report for quick inspection, with a bar
+// showing how full the bucket is.
+func (stats bucketStats) String() string {
+	const barWidth = 20
+	filled := 0
+	if stats.capacity > 0 {
+		filled = stats.depth * barWidth / stats.capacity
+	}
+
+	var report strings.Builder
+	fmt.Fprintf(&report, "%s\n", stats.name)
+	fmt.Fprintf(&report, "  Depth:        [%s%s] %d/%d\n", strings.Repeat("#", filled), strings.Repeat("-", barWidth-filled), stats.depth, stats.capacity)
+	fmt.Fprintf(&report, "  Workers:      %d\n", stats.workers)
+	fmt.Fprintf(&report, "  Processed:    %d\n", stats.processed)
+	fmt.Fprintf(&report, "  Service rate: %.2f/s\n", stats.serviceRate)
+	fmt.Fprintf(&report, "  Dropped:      %d\n", stats.dropped)
+	writeReasons(&report, stats.dropsByReason)
+	fmt.Fprintf(&report, "  Left:         %d\n", stats.left)
+	writeReasons(&report, stats.leftByReason)
+	return report.String()
+}
+
+// writeReasons writes counts to report as an indented line per reason code, in order of reason code.
+func writeReasons(report *strings.Builder, counts map[string]uint64) {
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(report, "    %-14s %d\n", reason+":", counts[reason])
+	}
+}
+
+// setPolicy attaches p to the bucket, replacing any policy already attached.
+func (bucket *leakyBucket) setPolicy(p policy) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.policy = p
+}
+
+// currentPolicy returns the policy attached to the bucket.
+func (bucket *leakyBucket) currentPolicy() policy {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	return bucket.policy
+}
+
+// startReporter calls report every interval with the stats of every bucket, keyed by bucket name, for a
+// single view across all of them. It returns a function that stops the reporter, and the reporter also
+// stops by itself once every bucket has been shut down, such as by shutdownAll.
+func startReporter(buckets []*leakyBucket, interval time.Duration, report func(map[string]bucketStats)) (stop func()) {
+	quit := make(chan struct{})
+	var quitOnce sync.Once
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			if allStopped(buckets) {
+				return
+			}
+			current := make(map[string]bucketStats, len(buckets))
+			for _, bucket := range buckets {
+				current[bucket.name] = bucket.stats()
+			}
+			report(current)
+		}
+	}()
+	return func() {
+		quitOnce.Do(func() { close(quit) })
+	}
+}
+
+// allStopped reports whether every one of buckets has been shut down.
+func allStopped(buckets []*leakyBucket) bool {
+	for _, bucket := range buckets {
+		select {
+		case <-bucket.stopped:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// aggregateByTag sums the stats of buckets sharing each value of tag, keyed by that value.
+// Every count and rate is summed, and the drops and left breakdowns are merged by reason. Fields that describe a single bucket,
+// such as its name, policy, and scaling and activation times, are left unset.
+// Buckets that do not carry tag are left out of the aggregation.
+func aggregateByTag(buckets []*leakyBucket, tag string) map[string]bucketStats {
+	aggregated := make(map[string]bucketStats)
+	for _, bucket := range buckets {
+		value, ok := bucket.tags[tag]
+		if !ok {
+			continue
+		}
+		current := bucket.stats()
+		total := aggregated[value]
+		if total.dropsByReason == nil {
+			total.dropsByReason = make(map[string]uint64)
+			total.leftByReason = make(map[string]uint64)
+		}
+		total.depth += current.depth
+		total.capacity += current.capacity
+		total.workers += current.workers
+		total.admitted += current.admitted
+		total.inFlight += current.inFlight
+		total.processed += current.processed
+		total.left += current.left
+		total.dropped += current.dropped
+		total.serviceRate += current.serviceRate
+		for reason, count := range current.dropsByReason {
+			total.dropsByReason[reason] += count
+		}
+		for reason, count := range current.leftByReason {
+			total.leftByReason[reason] += count
+		}
+		total.warmPool += current.warmPool
+		total.warmActivations += current.warmActivations
+		aggregated[value] = total
+	}
+	return aggregated
+}
+
+// suggestLeakInterval suggests the interval to pass to startLeakGate so that, for a steady arrivalRate in
+// requests per second, no more than maxDropRate (a fraction from 0 to 1) of requests are dropped.
+//
+// The model assumes arrivals are steady. Once a bucket fills it can only admit as many requests as it leaks,
+// so whenever arrivals outpace the leak the long run drop rate is 1 - leakRate/arrivalRate, and the leak
+// rate needed is arrivalRate * (1 - maxDropRate). Capacity only absorbs bursts and does not change the long
+// run rate. The leak gate releases one request every interval, so the interval is the reciprocal of the
+// leak rate, rounded down so the suggested leak is never slower than required.
+// When no leaking is required the suggested interval is 0, and the bucket does not need a leak gate.
+func suggestLeakInterval(arrivalRate, maxDropRate float64) time.Duration {
+	maxDropRate = math.Min(math.Max(maxDropRate, 0), 1)
+	leakRate := arrivalRate * (1 - maxDropRate)
+	if leakRate <= 0 {
+		return 0
+	}
+	interval := time.Duration(float64(time.Second) / leakRate)
+	if interval < 1 {
+		interval = 1
+	}
+	return interval
+}
+
+// initializeBucket initializes and returns a pointer to a leakyBucket struct.
+// A pointer is returned since the bucket's counters are shared by every Go routine operating on it.
+func initializeBucket(bucketName string, bucketCapacity int, workerCap int, workerMin int) *leakyBucket {
+	requests := make(chan request, bucketCapacity)
+	createdAt := time.Now()
+	return &leakyBucket{
+		requestChannel:     requests,
+		name:               bucketName,
+		workerCap:          workerCap,
+		workerMin:          workerMin,
+		producerBackoff:    constantBackoff{delay: 3 * time.Second},
+		processingTime:     750 * time.Millisecond,
+		rng:                rand.New(rand.NewSource(createdAt.UnixNano())),
+		batchSize:          1,
+		idleTimeout:        10 * time.Second,
+		scaleInterval:      250 * time.Millisecond,
+		clock:              time.Now,
+		statsInterval:      time.Minute,
+		createdAt:          createdAt,
+		currentInterval:    intervalStats{start: createdAt},
+		inSystemSince:      createdAt,
+		profile:            &hotPathProfile{},
+		closing:            make(chan struct{}),
+		slotFreed:          make(chan struct{}, 1),
+		drained:            make(chan struct{}, 1),
+		detach:             make(chan chan struct{}),
+		stopped:            make(chan struct{}),
+		oscillationWindow:  30 * time.Second,
+		processedTypes:     make(map[string]uint64),
+		pausedTypes:        make(map[string]bool),
+		resumed:            make(chan request),
+		queuedTypes:        make(map[string]int),
+		queuedKeys:         make(map[string]int),
+		observedTimes:      make(map[string]time.Duration),
+		droppedReasons:     make(map[string]uint64),
+		leftReasons:        make(map[string]uint64),
+		latestByKey:        make(map[string]uint64),
+		pendingCompletions: make(map[uint64]*request),
+	}
+}
+
+func main() {
+	loadTest := flag.Bool("loadtest", false, "run a load test against a bucket and print a report instead of the demo")
+	rate := flag.Float64("rate", 20, "requests offered per second during a load test")
+	duration := flag.Duration("duration", 10*time.Second, "how long a load test offers requests for")
+	capacity := flag.Int("capacity", 20, "capacity of the load tested bucket")
+	workerCap := flag.Int("worker-cap", 5, "maximum number of workers on the load tested bucket")
+	workerMin := flag.Int("worker-min", 3, "minimum number of workers on the load tested bucket")
+	flag.Parse()
+
+	if *loadTest {
+		if *rate <= 0 {
+			fmt.Println("The load test rate must be greater than 0.")
+			return
+		}
+		report := runLoadTest(loadTestConfig{
+			rate:         *rate,
+			duration:     *duration,
+			drainTimeout: 30 * time.Second,
+			capacity:     *capacity,
+			workerCap:    *workerCap,
+			workerMin:    *workerMin,
+		})
+		report.print()
+		return
+	}
+
+	// Create a bucket to simulate a rate limit that applies to all traffic coming into a server,
+	// regardless of origin or purpose. Its defaults can be overridden with environment variables.
+	globalBucket, err := initializeBucketFromEnv("")
+	if err != nil {
+		fmt.Printf("Unable to configure the bucket: %v\n", err)
+		return
+	}
+
+	// Fill the bucket halfway full with requests to start, aged over the last few seconds as if they had
+	// been arriving for a while. This is done just to showcase things more quickly in the demo.
+	globalBucket.prefillSpread = 5 * time.Second
+	globalBucket.prefill("Login Attempt", globalBucket.capacity()/2)
+
+	// Start simulating our leakyBucket receiving requests, with the bucket's minimum number of workers
+	// processing them and the worker pool adjusted dynamically, until the demo is interrupted.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	demo := newSupervisor(globalBucket)
+	demo.drainTimeout = 30 * time.Second
+	if err := demo.start(ctx); err != nil {
+		fmt.Printf("Unable to start the demo: %v\n", err)
+		return
+	}
 
+	// Report any errors until the demo is interrupted and the bucket has drained.
+	for err := range demo.errors() {
+		fmt.Printf("Demo error: %v\n", err)
 	}
 }
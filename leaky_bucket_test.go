@@ -0,0 +1,2650 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestBucket returns a bucket with the given capacity whose simulated requests take a microsecond,
+// so tests are not held up by the demo's processing time. No workers are started.
+func newTestBucket(capacity int, workerCap int, workerMin int) *leakyBucket {
+	bucket := initializeBucket("Test Bucket", capacity, workerCap, workerMin)
+	bucket.processingTime = time.Microsecond
+	bucket.producerBackoff = constantBackoff{delay: time.Millisecond}
+	return bucket
+}
+
+// shutdownTestBucket shuts bucket down, failing the test if it has not drained within a few seconds.
+func shutdownTestBucket(t *testing.T, bucket *leakyBucket) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := bucket.shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+}
+
+// waitFor polls condition until it holds, failing the test if it does not within timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %s waiting for %s", timeout, what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStatsSnapshotIsConsistent(t *testing.T) {
+	bucket := newTestBucket(8, 4, 4)
+	bucket.batchSize = 4
+	bucket.batchWait = time.Millisecond
+	for i := 0; i < 4; i++ {
+		spawnWorker(bucket)
+	}
+
+	const producers, perProducer = 4, 500
+	var offered sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		offered.Add(1)
+		go func() {
+			defer offered.Done()
+			for i := 0; i < perProducer; i++ {
+				bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		offered.Wait()
+		close(done)
+	}()
+
+	snapshots := 0
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		stats := bucket.stats()
+		snapshots++
+		accounted := uint64(stats.depth) + uint64(stats.inFlight) + stats.processed + stats.left
+		if stats.inFlight < 0 || stats.admitted != accounted {
+			t.Fatalf("snapshot %d: admitted %d, but depth %d + in flight %d + processed %d + left %d = %d",
+				snapshots, stats.admitted, stats.depth, stats.inFlight, stats.processed, stats.left, accounted)
+		}
+	}
+	shutdownTestBucket(t, bucket)
+}
+
+func TestStatsCanBeCalledFromCallbacks(t *testing.T) {
+	bucket := newTestBucket(4, 1, 1)
+	var depths []int
+	bucket.onEnqueue = func(req *request) {
+		depths = append(depths, bucket.stats().depth)
+	}
+	for i := 0; i < 3; i++ {
+		if err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); err != nil {
+			t.Fatalf("tryAdd: %v", err)
+		}
+	}
+	if len(depths) != 3 || depths[0] != 0 || depths[2] != 2 {
+		t.Fatalf("depths seen from onEnqueue = %v, want [0 1 2]", depths)
+	}
+}
+
+func TestStatsStringReport(t *testing.T) {
+	for _, tc := range []struct {
+		depth int
+		bar   string
+	}{
+		{0, "[--------------------] 0/10"},
+		{5, "[##########----------] 5/10"},
+		{10, "[####################] 10/10"},
+	} {
+		stats := bucketStats{
+			name:          "Test Bucket",
+			depth:         tc.depth,
+			capacity:      10,
+			workers:       3,
+			processed:     42,
+			serviceRate:   1.5,
+			dropped:       7,
+			dropsByReason: map[string]uint64{"full": 5, "shutdown": 2},
+			left:          3,
+			leftByReason:  map[string]uint64{"superseded": 3},
+		}
+		report := stats.String()
+		for _, want := range []string{"Test Bucket", tc.bar, "Workers:      3", "Processed:    42", "1.50/s", "Dropped:      7", "full:", "shutdown:", "Left:         3", "superseded:"} {
+			if !strings.Contains(report, want) {
+				t.Errorf("report for depth %d is missing %q:\n%s", tc.depth, want, report)
+			}
+		}
+	}
+}
+
+func TestStatsServiceRateCoversLastInterval(t *testing.T) {
+	bucket := newTestBucket(4, 1, 1)
+	now := bucket.createdAt
+	bucket.clock = func() time.Time { return now }
+	for i := 0; i < 30; i++ {
+		bucket.recordProcessed(request{requestType: "HTML Request", requestedAt: now})
+	}
+	now = now.Add(bucket.statsInterval)
+	if rate := bucket.stats().serviceRate; rate != 0.5 {
+		t.Fatalf("service rate = %v, want 0.5 for 30 requests over a minute", rate)
+	}
+}
+
+func TestStallWatchdogStaysWithinWorkerCap(t *testing.T) {
+	bucket := newTestBucket(20, 3, 2)
+	bucket.scaleInterval = 5 * time.Millisecond
+	bucket.stallWindow = 20 * time.Millisecond
+	unstuck := make(chan struct{})
+	bucket.setProcess(func(batch []request) { <-unstuck })
+	for i := 0; i < 2; i++ {
+		spawnWorker(bucket)
+	}
+	go workerPoolSizeAdjuster(bucket)
+	for i := 0; i < 20; i++ {
+		if err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); err != nil {
+			t.Fatalf("tryAdd %d: %v", i, err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if running := bucket.workerCount() + bucket.wedgedCount(); running > bucket.workerCap {
+			t.Fatalf("%d workers running or wedged, want at most workerCap %d", running, bucket.workerCap)
+		}
+		// The adjuster is the only Go routine on the bucket besides its workers.
+		if goroutines := bucket.activeGoroutines(); goroutines > bucket.workerCap+1 {
+			t.Fatalf("%d Go routines managing the bucket, want at most %d", goroutines, bucket.workerCap+1)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	bucket.mu.Lock()
+	stalls := bucket.stalls
+	bucket.mu.Unlock()
+	if stalls < 2 || stalls > 6 {
+		t.Fatalf("watchdog replaced the pool %d times in a second, want it to back off after the first few", stalls)
+	}
+
+	close(unstuck)
+	waitFor(t, 5*time.Second, "the queue to drain", func() bool { return bucket.stats().processed == 20 })
+	shutdownTestBucket(t, bucket)
+}
+
+func TestShutdownGivesUpWhenNothingDrains(t *testing.T) {
+	bucket := newTestBucket(4, 1, 1)
+	for i := 0; i < 2; i++ {
+		if err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); err != nil {
+			t.Fatalf("tryAdd: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := bucket.shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown with no workers = %v, want a deadline exceeded error", err)
+	}
+	if err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); !errors.Is(err, errShutdown) {
+		t.Fatalf("tryAdd after a timed out shutdown = %v, want errShutdown", err)
+	}
+
+	// A worker started afterwards drains the queue, and shutting down again finishes the job.
+	go processRequests(newWorker("Late Worker"), bucket)
+	shutdownTestBucket(t, bucket)
+	if processed := bucket.stats().processed; processed != 2 {
+		t.Fatalf("processed %d requests, want 2", processed)
+	}
+}
+
+func TestShutdownWaitsForARequestOnItsWayOutOfTheChannel(t *testing.T) {
+	bucket := newTestBucket(4, 1, 1)
+	if err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); err != nil {
+		t.Fatalf("tryAdd: %v", err)
+	}
+	// The request has left the channel, but nothing has yet recorded it as taken.
+	req := <-bucket.receiveChannel()
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- bucket.shutdown(ctx)
+	}()
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("shutdown returned %v with a request still queued, want it to wait", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	bucket.dequeued(req, true)
+	bucket.recordProcessed(req)
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Fatalf("shutdown = %v, want nil once the request was processed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shutdown did not return once the request was processed")
+	}
+}
+
+func TestConcurrentShutdownsAllReturn(t *testing.T) {
+	bucket := newTestBucket(8, 2, 2)
+	bucket.processingTime = 5 * time.Millisecond
+	for i := 0; i < 2; i++ {
+		spawnWorker(bucket)
+	}
+	for i := 0; i < 8; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	var shutdowns sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		shutdowns.Add(1)
+		go func() {
+			defer shutdowns.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := bucket.shutdown(ctx); err != nil {
+				t.Errorf("shutdown: %v", err)
+			}
+		}()
+	}
+	shutdowns.Wait()
+	if running := bucket.workerCount(); running != 0 {
+		t.Fatalf("%d workers still running after shutdown", running)
+	}
+}
+
+func TestOrderForReplayCorrectsClockSkew(t *testing.T) {
+	bucket := newTestBucket(4, 1, 1)
+	bucket.clockSkew = map[string]time.Duration{"ahead": 2 * time.Second, "behind": -time.Second}
+	base := time.Now()
+	reqs := []request{
+		{requestType: "first", source: "ahead", requestedAt: base.Add(2 * time.Second)},
+		{requestType: "third", source: "behind", requestedAt: base.Add(time.Second)},
+		{requestType: "second", source: "behind", requestedAt: base},
+	}
+	ordered := bucket.orderForReplay(reqs)
+	for i, want := range []string{"first", "second", "third"} {
+		if ordered[i].requestType != want {
+			t.Fatalf("replay order position %d = %s, want %s", i, ordered[i].requestType, want)
+		}
+	}
+}
+
+func TestClockSkewIsCorrectedOnce(t *testing.T) {
+	bucket := newTestBucket(4, 1, 1)
+	bucket.clockSkew = map[string]time.Duration{"ahead": time.Hour}
+	made := time.Now().Add(time.Hour)
+	if err := bucket.tryAdd(request{requestType: "HTML Request", source: "ahead", requestedAt: made}); err != nil {
+		t.Fatalf("tryAdd: %v", err)
+	}
+	extracted := bucket.extract()
+	if len(extracted) != 1 || !extracted[0].requestedAt.Equal(made.Add(-time.Hour)) {
+		t.Fatalf("extracted %v, want one request corrected by an hour", extracted)
+	}
+	if err := bucket.tryAdd(extracted[0]); err != nil {
+		t.Fatalf("tryAdd of the extracted request: %v", err)
+	}
+	readmitted := bucket.extract()
+	if !readmitted[0].requestedAt.Equal(extracted[0].requestedAt) {
+		t.Fatalf("re-admitting moved requestedAt from %v to %v", extracted[0].requestedAt, readmitted[0].requestedAt)
+	}
+
+	retried := request{requestType: "HTML Request", source: "ahead", requestedAt: made}.retry()
+	if err := bucket.tryAdd(retried); err != nil {
+		t.Fatalf("tryAdd of a retried request: %v", err)
+	}
+	if requeued := bucket.extract(); !requeued[0].requestedAt.Equal(retried.requestedAt) {
+		t.Fatalf("retried request was corrected from %v to %v", retried.requestedAt, requeued[0].requestedAt)
+	}
+}
+
+func TestTryAddBatchAdmitsTheFrontOfAnOversizedBatch(t *testing.T) {
+	bucket := newTestBucket(5, 1, 1)
+	if err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); err != nil {
+		t.Fatalf("tryAdd: %v", err)
+	}
+	batch := make([]request, 7)
+	for i := range batch {
+		batch[i] = request{requestType: "Batch Request", requestedAt: time.Now()}
+	}
+	outcomes := bucket.tryAddBatch(batch)
+	if len(outcomes) != len(batch) {
+		t.Fatalf("got %d outcomes for a batch of %d", len(outcomes), len(batch))
+	}
+	for i, err := range outcomes {
+		want := "admitted"
+		if i >= 4 {
+			want = "full"
+		}
+		if got := reasonCode(err); got != want {
+			t.Errorf("outcome %d = %s, want %s", i, got, want)
+		}
+	}
+	if dropped := bucket.dropsByReason()["full"]; dropped != 3 {
+		t.Errorf("recorded %d full drops, want 3", dropped)
+	}
+}
+
+func TestTryAddBatchIsNotInterleaved(t *testing.T) {
+	bucket := newTestBucket(200, 1, 1)
+	var producers sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		producers.Add(1)
+		go func(requestType string) {
+			defer producers.Done()
+			batch := make([]request, 50)
+			for i := range batch {
+				batch[i] = request{requestType: requestType, requestedAt: time.Now()}
+			}
+			bucket.tryAddBatch(batch)
+		}(string(rune('A' + p)))
+	}
+	producers.Wait()
+	queued := bucket.extract()
+	for i := 0; i < len(queued); i += 50 {
+		for _, req := range queued[i : i+50] {
+			if req.requestType != queued[i].requestType {
+				t.Fatalf("batch starting at %d interleaves %s with %s", i, queued[i].requestType, req.requestType)
+			}
+		}
+	}
+}
+
+func TestSuggestedLeakIntervalMeetsTheDropTarget(t *testing.T) {
+	// Each bucket is fed for a second of real time, so allow for the leak loop's ticks running a little late.
+	const duration = time.Second
+	const slack = 0.05
+	for _, tc := range []struct {
+		arrivalRate, maxDropRate float64
+		capacity                 int
+	}{
+		{arrivalRate: 200, maxDropRate: 0.5, capacity: 5},
+		{arrivalRate: 100, maxDropRate: 0.2, capacity: 10},
+		{arrivalRate: 50, maxDropRate: 0, capacity: 10},
+	} {
+		interval := suggestLeakInterval(tc.arrivalRate, tc.maxDropRate)
+		if interval <= 0 {
+			t.Fatalf("suggestLeakInterval(%v, %v) = %s, want a positive interval", tc.arrivalRate, tc.maxDropRate, interval)
+		}
+		bucket := newTestBucket(tc.capacity, 1, 1)
+		bucket.startLeakGate(interval)
+		spawnWorker(bucket)
+		started := time.Now()
+		for i := 0; ; i++ {
+			arrival := started.Add(time.Duration(float64(i) / tc.arrivalRate * float64(time.Second)))
+			if arrival.Sub(started) >= duration {
+				break
+			}
+			time.Sleep(time.Until(arrival))
+			bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+		}
+		stats := bucket.stats()
+		shutdownTestBucket(t, bucket)
+
+		arrived := stats.admitted + stats.dropped
+		if dropRate := float64(stats.dropped) / float64(arrived); dropRate > tc.maxDropRate+slack {
+			t.Errorf("leaking every %s at %v requests/s dropped %d of %d requests (%.3f), want at most %v",
+				interval, tc.arrivalRate, stats.dropped, arrived, dropRate, tc.maxDropRate)
+		}
+		if stats.dropsByReason["full"] != stats.dropped {
+			t.Errorf("dropped %d requests by reason %v, want every drop refused as full", stats.dropped, stats.dropsByReason)
+		}
+	}
+	if interval := suggestLeakInterval(10, 1); interval != 0 {
+		t.Errorf("suggestLeakInterval with every request allowed to drop = %s, want 0", interval)
+	}
+}
+
+func TestLeakGateAtTheSuggestedInterval(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	bucket.startLeakGate(suggestLeakInterval(100, 0))
+	spawnWorker(bucket)
+	for i := 0; i < 5; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	waitFor(t, 2*time.Second, "the gate to leak every request", func() bool { return bucket.stats().processed == 5 })
+	shutdownTestBucket(t, bucket)
+}
+
+func TestSetProcessSwapsForLaterBatches(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	var mu sync.Mutex
+	handledBy := make(map[string]string)
+	record := func(name string, batch []request) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, req := range batch {
+			handledBy[req.requestType] = name
+		}
+	}
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	bucket.setProcess(func(batch []request) {
+		close(started)
+		<-finish
+		record("old", batch)
+	})
+	spawnWorker(bucket)
+	bucket.tryAdd(request{requestType: "in flight", requestedAt: time.Now()})
+	<-started
+
+	bucket.setProcess(func(batch []request) { record("new", batch) })
+	bucket.tryAdd(request{requestType: "dequeued after the swap", requestedAt: time.Now()})
+	close(finish)
+	waitFor(t, 2*time.Second, "both requests to be processed", func() bool { return bucket.stats().processed == 2 })
+	shutdownTestBucket(t, bucket)
+
+	if handledBy["in flight"] != "old" || handledBy["dequeued after the swap"] != "new" {
+		t.Fatalf("requests were handled by %v, want the in flight one by the old function and the later one by the new", handledBy)
+	}
+}
+
+func TestProcessFunctionReceivesWholeBatches(t *testing.T) {
+	bucket := newTestBucket(8, 1, 1)
+	bucket.batchSize = 4
+	bucket.batchWait = time.Second
+	batches := make(chan int, 8)
+	bucket.setProcess(func(batch []request) { batches <- len(batch) })
+	for i := 0; i < 8; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	spawnWorker(bucket)
+	waitFor(t, 2*time.Second, "every request to be processed", func() bool { return bucket.stats().processed == 8 })
+	shutdownTestBucket(t, bucket)
+	close(batches)
+	for size := range batches {
+		if size != 4 {
+			t.Fatalf("process was called with a batch of %d, want 4", size)
+		}
+	}
+}
+
+func TestProcessedByTypeTalliesEachType(t *testing.T) {
+	bucket := newTestBucket(20, 2, 2)
+	want := map[string]uint64{"Login Attempt": 3, "HTML Request": 5, "Image Request": 2}
+	for requestType, count := range want {
+		for i := uint64(0); i < count; i++ {
+			if err := bucket.tryAdd(request{requestType: requestType, requestedAt: time.Now()}); err != nil {
+				t.Fatalf("tryAdd: %v", err)
+			}
+		}
+	}
+	for i := 0; i < 2; i++ {
+		spawnWorker(bucket)
+	}
+	waitFor(t, 2*time.Second, "every request to be processed", func() bool { return bucket.stats().processed == 10 })
+	shutdownTestBucket(t, bucket)
+
+	byType := bucket.processedByType()
+	var sum uint64
+	for requestType, count := range byType {
+		if count != want[requestType] {
+			t.Errorf("processed %d requests of type %s, want %d", count, requestType, want[requestType])
+		}
+		sum += count
+	}
+	if sum != bucket.stats().processed {
+		t.Errorf("per type tallies sum to %d, want the %d processed", sum, bucket.stats().processed)
+	}
+	byType["Login Attempt"] = 100
+	if bucket.processedByType()["Login Attempt"] != 3 {
+		t.Error("changing the returned map changed the bucket's tallies")
+	}
+}
+
+func TestStatsStayResponsiveDuringScaleUp(t *testing.T) {
+	bucket := newTestBucket(100, 40, 1)
+	bucket.scaleInterval = time.Millisecond
+	bucket.criticalWait = time.Millisecond
+	unblock := make(chan struct{})
+	bucket.setProcess(func(batch []request) { <-unblock })
+	for i := 0; i < 100; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	go workerPoolSizeAdjuster(bucket)
+
+	var slowest time.Duration
+	for deadline := time.Now().Add(200 * time.Millisecond); time.Now().Before(deadline); {
+		called := time.Now()
+		bucket.stats()
+		bucket.workerCount()
+		if took := time.Since(called); took > slowest {
+			slowest = took
+		}
+	}
+	if workers := bucket.workerCount(); workers != bucket.workerCap {
+		t.Errorf("pool scaled to %d workers, want workerCap %d", workers, bucket.workerCap)
+	}
+	if slowest > 50*time.Millisecond {
+		t.Errorf("stats and workerCount took up to %s during the scale up, want them to stay responsive", slowest)
+	}
+	close(unblock)
+	shutdownTestBucket(t, bucket)
+}
+
+func TestWarmupAcceptsRequestsButDefersScaling(t *testing.T) {
+	bucket := newTestBucket(10, 3, 0)
+	bucket.scaleInterval = time.Millisecond
+	bucket.warmup = 100 * time.Millisecond
+	bucket.warmupAcceptOnly = true
+	go workerPoolSizeAdjuster(bucket)
+	for i := 0; i < 10; i++ {
+		if err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); err != nil {
+			t.Fatalf("tryAdd during warmup: %v", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if workers := bucket.workerCount(); workers != 0 || bucket.depth() != 10 {
+		t.Fatalf("during warmup: %d workers and %d queued, want 0 workers and all 10 requests queued", workers, bucket.depth())
+	}
+	// The worker may drain the queue and be scaled back down between polls, so check one was ever spawned.
+	waitFor(t, 2*time.Second, "the pool to scale up after warmup", func() bool {
+		bucket.mu.Lock()
+		defer bucket.mu.Unlock()
+		return bucket.workersRegistered > 0
+	})
+	if bucket.warmingUp() {
+		t.Fatal("the pool scaled up before warmup ended")
+	}
+	waitFor(t, 2*time.Second, "the queued requests to be processed", func() bool { return bucket.stats().processed == 10 })
+	shutdownTestBucket(t, bucket)
+}
+
+func TestSwapQueueUnderConcurrentProcessing(t *testing.T) {
+	bucket := newTestBucket(16, 4, 4)
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	bucket.setProcess(func(batch []request) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, req := range batch {
+			seen[req.key]++
+		}
+	})
+	for i := 0; i < 4; i++ {
+		spawnWorker(bucket)
+	}
+
+	const total = 2000
+	add := func(req request) {
+		for bucket.tryAdd(req) != nil {
+			time.Sleep(10 * time.Microsecond)
+		}
+	}
+	produced := make(chan struct{})
+	go func() {
+		defer close(produced)
+		for i := 0; i < total; i++ {
+			add(request{requestType: "HTML Request", key: fmt.Sprint(i), requestedAt: time.Now()})
+		}
+	}()
+	// Keep swapping the requests taken out by the previous swap back in, so requests are constantly
+	// moving in and out of the bucket while the workers process it.
+	var held []request
+	for swapping := true; swapping; {
+		select {
+		case <-produced:
+			swapping = false
+		default:
+			held = bucket.swapQueue(held)
+		}
+	}
+	for _, req := range held {
+		add(req)
+	}
+
+	waitFor(t, 5*time.Second, "every request to be processed", func() bool { return bucket.stats().processed == total })
+	shutdownTestBucket(t, bucket)
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < total; i++ {
+		if count := seen[fmt.Sprint(i)]; count != 1 {
+			t.Errorf("request %d was processed %d times, want exactly once", i, count)
+		}
+	}
+}
+
+func TestMinProcessingTimeIsAFloor(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	bucket.minProcessingTime = 2 * time.Millisecond
+	bucket.seedRandom(1)
+	bucket.thinkTime = normalThinkTime{average: 2 * time.Millisecond, stdDev: 5 * time.Millisecond}
+	for i := 0; i < 1000; i++ {
+		if took := bucket.serviceTime(request{requestType: "HTML Request"}); took < bucket.minProcessingTime {
+			t.Fatalf("sampled a service time of %s, below the minimum of %s", took, bucket.minProcessingTime)
+		}
+	}
+	if mean := bucket.meanServiceTime(); mean < bucket.minProcessingTime {
+		t.Fatalf("mean service time %s is below the minimum of %s", mean, bucket.minProcessingTime)
+	}
+
+	// Processed end to end, each request takes at least the minimum even though processingTime is shorter.
+	bucket.thinkTime = nil
+	for i := 0; i < 5; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	started := time.Now()
+	spawnWorker(bucket)
+	waitFor(t, 2*time.Second, "every request to be processed", func() bool { return bucket.stats().processed == 5 })
+	if took := time.Since(started); took < 5*bucket.minProcessingTime {
+		t.Fatalf("one worker processed 5 requests in %s, less than 5 times the minimum of %s", took, bucket.minProcessingTime)
+	}
+	shutdownTestBucket(t, bucket)
+
+	// The floor applies to each request of a batch, whether or not a process function handles it.
+	for _, custom := range []bool{false, true} {
+		batched := newTestBucket(10, 1, 1)
+		batched.minProcessingTime = 2 * time.Millisecond
+		batched.batchSize = 5
+		var batches atomic.Int64
+		if custom {
+			batched.setProcess(func(batch []request) { batches.Add(1) })
+		}
+		for i := 0; i < 5; i++ {
+			batched.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+		}
+		started := time.Now()
+		spawnWorker(batched)
+		waitFor(t, 2*time.Second, "the batch to be processed", func() bool { return batched.stats().processed == 5 })
+		if took := time.Since(started); took < 5*batched.minProcessingTime {
+			t.Fatalf("a batch of 5 requests (custom process %t) took %s, less than 5 times the minimum of %s", custom, took, batched.minProcessingTime)
+		}
+		if custom && batches.Load() == 0 {
+			t.Fatal("the custom process function was never called")
+		}
+		shutdownTestBucket(t, batched)
+	}
+}
+
+func TestOscillationRisesOnlyUnderFlappingLoad(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	now := time.Now()
+	bucket.clock = func() time.Time { return now }
+	observe := func() {
+		now = now.Add(time.Second)
+		bucket.observeZone(bucket.zone())
+	}
+
+	// Steady load: the depth sits between the watermarks.
+	for i := 0; i < 5; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: now})
+	}
+	for i := 0; i < 10; i++ {
+		observe()
+	}
+	if steady := bucket.oscillation(); steady > 1 {
+		t.Fatalf("oscillation under steady load = %d, want at most 1", steady)
+	}
+
+	// Oscillating load: the bucket is filled past the high watermark and emptied again and again.
+	for i := 0; i < 10; i++ {
+		for bucket.tryAdd(request{requestType: "HTML Request", requestedAt: now}) == nil {
+		}
+		observe()
+		bucket.extract()
+		observe()
+	}
+	if flapping := bucket.oscillation(); flapping < 15 {
+		t.Fatalf("oscillation under flapping load = %d, want it to count the crossings", flapping)
+	}
+
+	// Once the flapping stops, the crossings age out of the window.
+	now = now.Add(bucket.oscillationWindow + time.Second)
+	if settled := bucket.oscillation(); settled != 0 {
+		t.Fatalf("oscillation after the window passed = %d, want 0", settled)
+	}
+}
+
+func TestBatchesShrinkWhenTheQueueIsNearlyEmpty(t *testing.T) {
+	bucket := newTestBucket(20, 1, 1)
+	bucket.batchSize = 5
+	bucket.batchWait = 10 * time.Millisecond
+	batches := make(chan int, 20)
+	bucket.setProcess(func(batch []request) { batches <- len(batch) })
+	for i := 0; i < 12; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	spawnWorker(bucket)
+	waitFor(t, 2*time.Second, "every request to be processed", func() bool { return bucket.stats().processed == 12 })
+	shutdownTestBucket(t, bucket)
+	close(batches)
+
+	var sizes []int
+	for size := range batches {
+		sizes = append(sizes, size)
+	}
+	if len(sizes) != 3 || sizes[0] != 5 || sizes[1] != 5 || sizes[2] != 2 {
+		t.Fatalf("batch sizes = %v, want [5 5 2]", sizes)
+	}
+}
+
+func TestOnEnqueueEnrichmentIsSeenByWorkers(t *testing.T) {
+	bucket := newTestBucket(4, 1, 1)
+	bucket.onEnqueue = func(req *request) { req.key = "trace-" + req.requestType }
+	seen := make(chan string, 1)
+	bucket.setProcess(func(batch []request) { seen <- batch[0].key })
+	spawnWorker(bucket)
+	if err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); err != nil {
+		t.Fatalf("tryAdd: %v", err)
+	}
+	select {
+	case key := <-seen:
+		if key != "trace-HTML Request" {
+			t.Fatalf("worker saw key %q, want the one set by onEnqueue", key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the request to be processed")
+	}
+	shutdownTestBucket(t, bucket)
+}
+
+func TestPrefillStopsAtCapacity(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	done := make(chan struct{})
+	var enqueued, refused int
+	go func() {
+		defer close(done)
+		enqueued, refused = bucket.prefill("Login Attempt", 25)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("prefill blocked on a full bucket")
+	}
+	if enqueued != 10 || refused != 15 || bucket.depth() != 10 {
+		t.Fatalf("prefill enqueued %d and refused %d leaving %d queued, want 10, 15, and 10", enqueued, refused, bucket.depth())
+	}
+}
+
+func TestMaxQueueWaitRefusesRequestsUpFront(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	bucket.processingTime = 100 * time.Millisecond
+	bucket.maxQueueWait = 250 * time.Millisecond
+	for i := 0; i < 3; i++ {
+		if err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); err != nil {
+			t.Fatalf("tryAdd %d with an estimated wait of %s: %v", i, bucket.estimateWait(), err)
+		}
+	}
+	err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	if !errors.Is(err, errWaitTooLong) || reasonCode(err) != "wait_too_long" {
+		t.Fatalf("tryAdd with an estimated wait of %s = %v, want errWaitTooLong", bucket.estimateWait(), err)
+	}
+	if bucket.depth() != 3 {
+		t.Fatalf("%d requests queued, want the refused one left off the bucket", bucket.depth())
+	}
+}
+
+func TestIntervalStatsAreIndependentPerInterval(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	now := bucket.createdAt
+	bucket.clock = func() time.Time { return now }
+	bucket.statsInterval = 10 * time.Second
+	processed := func(count int) {
+		for i := 0; i < count; i++ {
+			bucket.recordProcessed(request{requestType: "HTML Request", requestedAt: now})
+		}
+	}
+
+	processed(3)
+	bucket.recordDropped(2, errBucketFull)
+	if last := bucket.intervalStats(); last.processed != 0 || last.dropped != 0 {
+		t.Fatalf("before the first interval ends, last interval = %+v, want it empty", last)
+	}
+	now = now.Add(10 * time.Second)
+	processed(5)
+	if last := bucket.intervalStats(); last.processed != 3 || last.dropped != 2 {
+		t.Fatalf("first interval = %+v, want 3 processed and 2 dropped", last)
+	}
+	now = now.Add(10 * time.Second)
+	if last := bucket.intervalStats(); last.processed != 5 || last.dropped != 0 {
+		t.Fatalf("second interval = %+v, want 5 processed and none dropped", last)
+	}
+	now = now.Add(30 * time.Second)
+	if last := bucket.intervalStats(); last.processed != 0 || last.dropped != 0 {
+		t.Fatalf("after idle intervals, last interval = %+v, want it empty", last)
+	}
+	if total := bucket.stats().processed; total != 8 {
+		t.Fatalf("cumulative processed = %d, want 8", total)
+	}
+}
+
+func TestBroadcastIsAcknowledgedOncePerWorker(t *testing.T) {
+	bucket := newTestBucket(10, 4, 4)
+	for i := 0; i < 4; i++ {
+		spawnWorker(bucket)
+	}
+	waitFor(t, time.Second, "the workers to start", func() bool { return bucket.activeGoroutines() == 4 })
+	var mu sync.Mutex
+	acks := make(map[string]int)
+	bucket.broadcast(workerCommand{name: "noop", acknowledge: func(workerName string) {
+		mu.Lock()
+		defer mu.Unlock()
+		acks[workerName]++
+	}})
+	// broadcast returns once every worker has received the command, and each acknowledges it right after.
+	waitFor(t, time.Second, "every worker to acknowledge", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(acks) == 4
+	})
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	for workerName, count := range acks {
+		if count != 1 {
+			t.Errorf("%s acknowledged the command %d times, want once", workerName, count)
+		}
+	}
+	shutdownTestBucket(t, bucket)
+}
+
+func TestZeroValueBucketReturnsErrNotInitialized(t *testing.T) {
+	var bucket leakyBucket
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := bucket.tryAdd(request{requestType: "HTML Request"}); !errors.Is(err, errNotInitialized) {
+			t.Errorf("tryAdd = %v, want errNotInitialized", err)
+		}
+		if errs := bucket.tryAddBatch([]request{{requestType: "HTML Request"}}); !errors.Is(errs[0], errNotInitialized) {
+			t.Errorf("tryAddBatch = %v, want errNotInitialized", errs)
+		}
+		if err := bucket.acquire(context.Background()); !errors.Is(err, errNotInitialized) {
+			t.Errorf("acquire = %v, want errNotInitialized", err)
+		}
+		if err := bucket.shutdown(context.Background()); !errors.Is(err, errNotInitialized) {
+			t.Errorf("shutdown = %v, want errNotInitialized", err)
+		}
+		if err := bucket.pauseType("Image Request"); !errors.Is(err, errNotInitialized) {
+			t.Errorf("pauseType = %v, want errNotInitialized", err)
+		}
+		if previous := bucket.swapQueue([]request{{requestType: "HTML Request"}}); previous != nil {
+			t.Errorf("swapQueue = %v, want nothing replaced", previous)
+		}
+		if extracted := bucket.extract(); extracted != nil {
+			t.Errorf("extract = %v, want nothing extracted", extracted)
+		}
+		if stats := bucket.stats(); stats.depth != 0 || stats.capacity != 0 {
+			t.Errorf("stats = %+v, want an empty summary", stats)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("calls on a zero-value bucket blocked")
+	}
+}
+
+func TestCoarseClockStaysWithinItsResolution(t *testing.T) {
+	const resolution = 5 * time.Millisecond
+	// Ticks can be delivered a little late on a busy machine, so allow some scheduling slack.
+	const slack = 20 * time.Millisecond
+	bucket := newTestBucket(4, 1, 1)
+	// The clock's refresh Go routine must exit once the bucket is shut down.
+	assertNoLeaks(t, bucket, func() {
+		bucket.useCoarseClock(resolution)
+		for i := 0; i < 100; i++ {
+			stamped := bucket.requestTime()
+			lag := time.Since(stamped)
+			if lag < 0 || lag > resolution+slack {
+				t.Fatalf("coarse timestamp lags the true time by %s, want at most %s", lag, resolution)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+func BenchmarkRequestTime(b *testing.B) {
+	for _, bench := range []struct {
+		name       string
+		resolution time.Duration
+	}{
+		{"precise", 0},
+		{"coarse", time.Millisecond},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			bucket := newTestBucket(4, 1, 1)
+			if bench.resolution > 0 {
+				bucket.useCoarseClock(bench.resolution)
+			}
+			for i := 0; i < b.N; i++ {
+				bucket.requestTime()
+			}
+			if err := bucket.shutdown(context.Background()); err != nil {
+				b.Fatalf("shutdown: %v", err)
+			}
+		})
+	}
+}
+
+func TestAggregateByTagSumsEachTagValue(t *testing.T) {
+	east1 := newTestBucket(10, 1, 1)
+	east2 := newTestBucket(20, 1, 1)
+	west := newTestBucket(5, 1, 1)
+	untagged := newTestBucket(8, 1, 1)
+	east1.tags = map[string]string{"region": "east"}
+	east2.tags = map[string]string{"region": "east"}
+	west.tags = map[string]string{"region": "west"}
+	for bucket, queued := range map[*leakyBucket]int{east1: 3, east2: 4, west: 5, untagged: 1} {
+		bucket.prefill("HTML Request", queued)
+	}
+	west.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	for _, bucket := range []*leakyBucket{east1, east2} {
+		if err := bucket.pauseType("Image Request"); err != nil {
+			t.Fatalf("pauseType = %v, want nil", err)
+		}
+		bucket.tryAdd(request{requestType: "Image Request", requestedAt: time.Now()})
+	}
+	// Take one request off each east bucket into flight, and have east1 give up on another.
+	for _, bucket := range []*leakyBucket{east1, east2} {
+		bucket.dequeued(<-bucket.requestChannel, true)
+	}
+	east1.dequeued(<-east1.requestChannel, false)
+	// Each east bucket processed 30 requests over the last stats interval, a rate of 0.5 per second.
+	for _, bucket := range []*leakyBucket{east1, east2} {
+		now := bucket.createdAt
+		bucket.clock = func() time.Time { return now }
+		for i := 0; i < 30; i++ {
+			bucket.inFlight.Add(1)
+			bucket.recordProcessed(request{requestType: "HTML Request", requestedAt: now})
+		}
+		now = now.Add(bucket.statsInterval)
+	}
+
+	aggregated := aggregateByTag([]*leakyBucket{east1, east2, west, untagged}, "region")
+	if len(aggregated) != 2 {
+		t.Fatalf("aggregated %d region values, want east and west", len(aggregated))
+	}
+	eastStats := aggregated["east"]
+	if eastStats.depth != 4 || eastStats.capacity != 30 || eastStats.admitted != 7 || eastStats.inFlight != 2 || eastStats.left != 1 {
+		t.Errorf("east = depth %d, capacity %d, admitted %d, in flight %d, left %d, want 4, 30, 7, 2, and 1",
+			eastStats.depth, eastStats.capacity, eastStats.admitted, eastStats.inFlight, eastStats.left)
+	}
+	if eastStats.processed != 60 || eastStats.serviceRate != 1 {
+		t.Errorf("east = processed %d at %v/s, want 60 at 1/s", eastStats.processed, eastStats.serviceRate)
+	}
+	if eastStats.dropped != 2 || len(eastStats.dropsByReason) != 1 || eastStats.dropsByReason["type_paused"] != 2 {
+		t.Errorf("east = dropped %d by reason %v, want 2 type_paused", eastStats.dropped, eastStats.dropsByReason)
+	}
+	westStats := aggregated["west"]
+	if westStats.depth != 5 || westStats.capacity != 5 || westStats.admitted != 5 || westStats.dropped != 1 || westStats.dropsByReason["full"] != 1 {
+		t.Errorf("west = depth %d, capacity %d, admitted %d, dropped %d by reason %v, want 5, 5, 5, and 1 full",
+			westStats.depth, westStats.capacity, westStats.admitted, westStats.dropped, westStats.dropsByReason)
+	}
+}
+
+func TestAuditRecordsProcessingOrderAndWorker(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	var audit bytes.Buffer
+	bucket.auditWriter = &audit
+	for i := 0; i < 5; i++ {
+		bucket.tryAdd(request{requestType: fmt.Sprintf("Request %d", i), requestedAt: time.Now()})
+	}
+	spawnWorker(bucket)
+	waitFor(t, 2*time.Second, "every request to be processed", func() bool { return bucket.stats().processed == 5 })
+	shutdownTestBucket(t, bucket)
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("audit has %d records, want 5:\n%s", len(lines), audit.String())
+	}
+	for i, line := range lines {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 || fields[1] != "Worker 1" || fields[2] != fmt.Sprintf("Request %d", i) {
+			t.Errorf("audit record %d = %q, want Request %d processed by Worker 1", i, line, i)
+		}
+	}
+}
+
+func TestOrderedCompletionsFireInSubmissionOrder(t *testing.T) {
+	bucket := newTestBucket(8, 4, 4)
+	bucket.orderedCompletions = true
+	var mu sync.Mutex
+	var finished, completed []uint64
+	bucket.setProcess(func(batch []request) {
+		// Earlier requests take longer, so the workers finish them out of order.
+		time.Sleep(time.Duration(8-batch[0].sequence) * 5 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		finished = append(finished, batch[0].sequence)
+	})
+	bucket.onComplete = func(req request) {
+		mu.Lock()
+		defer mu.Unlock()
+		completed = append(completed, req.sequence)
+	}
+	for i := 0; i < 8; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	for i := 0; i < 4; i++ {
+		spawnWorker(bucket)
+	}
+	waitFor(t, 2*time.Second, "every request to be processed", func() bool { return bucket.stats().processed == 8 })
+	shutdownTestBucket(t, bucket)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sort.SliceIsSorted(finished, func(i, j int) bool { return finished[i] < finished[j] }) {
+		t.Fatalf("requests finished in order %v, so the test did not exercise reordering", finished)
+	}
+	if len(completed) != 8 || !sort.SliceIsSorted(completed, func(i, j int) bool { return completed[i] < completed[j] }) {
+		t.Fatalf("completions fired in order %v, want submission order", completed)
+	}
+}
+
+func TestStoppingAWorkerTwiceNeverBlocks(t *testing.T) {
+	bucket := newTestBucket(10, 8, 0)
+	for i := 0; i < 8; i++ {
+		spawnWorker(bucket)
+	}
+	bucket.mu.Lock()
+	workers := append([]worker(nil), bucket.workers...)
+	bucket.mu.Unlock()
+
+	// Race direct stops against the adjuster's scale down stopping the same, newest, workers.
+	var racing sync.WaitGroup
+	for _, target := range workers {
+		racing.Add(2)
+		go func(target worker) {
+			defer racing.Done()
+			target.stop()
+			target.stop()
+		}(target)
+		go func() {
+			defer racing.Done()
+			bucket.stopNewestWorker()
+		}()
+	}
+	finished := make(chan struct{})
+	go func() {
+		racing.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("stopping workers deadlocked")
+	}
+	for _, stopped := range workers {
+		select {
+		case <-stopped.done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s did not exit after being stopped", stopped.name)
+		}
+	}
+	if running := bucket.workerCount(); running != 0 {
+		t.Fatalf("%d workers left in the pool, want 0", running)
+	}
+}
+
+func TestReceiveChannelLetsCallersConsumeRequests(t *testing.T) {
+	bucket := newTestBucket(4, 1, 1)
+	for i := 0; i < 3; i++ {
+		bucket.tryAdd(request{requestType: fmt.Sprintf("Request %d", i), requestedAt: time.Now()})
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case req := <-bucket.receiveChannel():
+			if want := fmt.Sprintf("Request %d", i); req.requestType != want {
+				t.Fatalf("received %s, want %s", req.requestType, want)
+			}
+			bucket.dequeued(req, true)
+			bucket.recordProcessed(req)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out receiving request %d", i)
+		}
+	}
+	stats := bucket.stats()
+	if stats.depth != 0 || stats.processed != 3 || stats.inFlight != 0 || stats.admitted != 3 {
+		t.Fatalf("after consuming every request, stats = %+v, want none queued or in flight and 3 processed", stats)
+	}
+}
+
+func TestCriticalWaitScalesStraightToWorkerCap(t *testing.T) {
+	bucket := newTestBucket(100, 6, 1)
+	var mu sync.Mutex
+	now := time.Now()
+	bucket.clock = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	bucket.scaleInterval = 50 * time.Millisecond
+	bucket.criticalWait = time.Second
+	unblock := make(chan struct{})
+	bucket.setProcess(func(batch []request) { <-unblock })
+	// A single queued request keeps the depth below the high watermark, so only criticalWait can scale up.
+	bucket.tryAdd(request{requestType: "HTML Request", requestedAt: now})
+	mu.Lock()
+	now = now.Add(2 * time.Second)
+	mu.Unlock()
+
+	go workerPoolSizeAdjuster(bucket)
+	time.Sleep(75 * time.Millisecond)
+	if workers := bucket.workerCount(); workers != bucket.workerCap {
+		t.Fatalf("after one evaluation the pool has %d workers, want workerCap %d", workers, bucket.workerCap)
+	}
+	close(unblock)
+	shutdownTestBucket(t, bucket)
+}
+
+func TestClockSteppingBackwardsClampsDurations(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	now := bucket.createdAt.Add(time.Minute)
+	bucket.clock = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: now})
+	}
+	now = now.Add(-time.Hour)
+
+	if wait := bucket.oldestWait(); wait != 0 {
+		t.Errorf("oldestWait after the clock stepped back = %s, want 0", wait)
+	}
+	if age := bucket.since(now.Add(time.Minute)); age != 0 {
+		t.Errorf("since a time in the future = %s, want 0", age)
+	}
+	for i := 0; i < 3; i++ {
+		req := <-bucket.receiveChannel()
+		bucket.dequeued(req, true)
+		bucket.recordProcessed(req)
+	}
+	if L, lambda, W := bucket.littlesLaw(); L < 0 || lambda < 0 || W < 0 {
+		t.Errorf("littlesLaw after the clock stepped back = %v, %v, %v, want no negatives", L, lambda, W)
+	}
+	if rate := bucket.serviceRate(time.Minute); rate < 0 {
+		t.Errorf("serviceRate after the clock stepped back = %v, want no negative rate", rate)
+	}
+	if full := bucket.fullDuration(); full < 0 {
+		t.Errorf("fullDuration after the clock stepped back = %s, want no negative duration", full)
+	}
+}
+
+func TestServiceRateMatchesTheWorkerPool(t *testing.T) {
+	bucket := newTestBucket(50, 2, 2)
+	bucket.completionHistory = time.Minute
+	bucket.processingTime = 10 * time.Millisecond
+	for i := 0; i < 50; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	for i := 0; i < 2; i++ {
+		spawnWorker(bucket)
+	}
+	// Two workers spending 10ms per request complete 200 requests a second while the queue stays busy.
+	time.Sleep(200 * time.Millisecond)
+	rate := bucket.serviceRate(150 * time.Millisecond)
+	if rate < 100 || rate > 220 {
+		t.Errorf("service rate = %.1f/s, want about 200/s", rate)
+	}
+	shutdownTestBucket(t, bucket)
+}
+
+func TestPaceSpacesOutProcessingStarts(t *testing.T) {
+	bucket := newTestBucket(10, 4, 4)
+	bucket.pace = 20 * time.Millisecond
+	var mu sync.Mutex
+	var starts []time.Time
+	bucket.setProcess(func(batch []request) {
+		mu.Lock()
+		defer mu.Unlock()
+		starts = append(starts, time.Now())
+	})
+	for i := 0; i < 4; i++ {
+		spawnWorker(bucket)
+	}
+	// The whole burst arrives at once, with four idle workers ready to take it.
+	for i := 0; i < 6; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	waitFor(t, 2*time.Second, "the burst to be processed", func() bool { return bucket.stats().processed == 6 })
+	shutdownTestBucket(t, bucket)
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	for i := 1; i < len(starts); i++ {
+		// Allow for the process function being called a moment after the pacer releases the start.
+		if gap := starts[i].Sub(starts[i-1]); gap < bucket.pace-5*time.Millisecond {
+			t.Errorf("processing starts %d and %d were %s apart, want about %s", i-1, i, gap, bucket.pace)
+		}
+	}
+}
+
+func TestQuiescedOnlyOnceTheWorkIsDone(t *testing.T) {
+	bucket := newTestBucket(10, 2, 1)
+	if !bucket.quiesced() {
+		t.Fatal("a new, empty bucket is not quiesced")
+	}
+	unblock := make(chan struct{})
+	bucket.setProcess(func(batch []request) { <-unblock })
+	for i := 0; i < 3; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	if bucket.quiesced() {
+		t.Fatal("quiesced with requests queued")
+	}
+	spawnWorker(bucket)
+	waitFor(t, time.Second, "a request to be taken in flight", func() bool { return bucket.stats().inFlight == 1 })
+	if bucket.quiesced() {
+		t.Fatal("quiesced with a request in flight")
+	}
+	spawnWorker(bucket)
+	close(unblock)
+	waitFor(t, time.Second, "every request to be processed", func() bool { return bucket.stats().processed == 3 })
+	if bucket.quiesced() {
+		t.Fatal("quiesced with a scale down still pending")
+	}
+	bucket.stopNewestWorker()
+	if !bucket.quiesced() {
+		t.Fatal("not quiesced once the work was done and the pool was back at workerMin")
+	}
+	shutdownTestBucket(t, bucket)
+}
+
+func TestFullDurationTracksTimeSpentFull(t *testing.T) {
+	bucket := newTestBucket(3, 1, 1)
+	bucket.completionHistory = time.Minute
+	now := time.Now()
+	bucket.clock = func() time.Time { return now }
+	bucket.prefill("HTML Request", 3)
+	now = now.Add(4 * time.Second)
+	if full := bucket.fullDuration(); full != 4*time.Second {
+		t.Fatalf("fullDuration while still full = %s, want 4s", full)
+	}
+
+	bucket.extract()
+	now = now.Add(6 * time.Second)
+	if full := bucket.fullDuration(); full != 4*time.Second {
+		t.Fatalf("fullDuration after leaving full = %s, want 4s", full)
+	}
+	if ratio := bucket.fullRatio(10 * time.Second); math.Abs(ratio-0.4) > 0.001 {
+		t.Fatalf("fullRatio over 10s = %v, want 0.4", ratio)
+	}
+	if ratio := bucket.fullRatio(5 * time.Second); ratio != 0 {
+		t.Fatalf("fullRatio over the last 5s = %v, want 0", ratio)
+	}
+}
+
+func TestAdmissionLogRecordsDecisionsWithReasonCodes(t *testing.T) {
+	bucket := newTestBucket(2, 1, 1)
+	var log bytes.Buffer
+	bucket.admissionLog = &log
+	bucket.admissionSampleRate = 1
+	for i := 0; i < 3; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	want := [][2]string{{"admitted", "admitted"}, {"admitted", "admitted"}, {"rejected", "full"}}
+	if len(lines) != len(want) {
+		t.Fatalf("admission log has %d records, want %d:\n%s", len(lines), len(want), log.String())
+	}
+	for i, line := range lines {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 || fields[1] != "Test Bucket" || fields[3] != want[i][0] || fields[4] != want[i][1] {
+			t.Errorf("admission record %d = %q, want %s with reason %s", i, line, want[i][0], want[i][1])
+		}
+	}
+}
+
+func TestAdmissionLogIsSampled(t *testing.T) {
+	bucket := newTestBucket(1, 1, 1)
+	var log bytes.Buffer
+	bucket.admissionLog = &log
+	bucket.admissionSampleRate = 0.25
+	const decisions = 4000
+	for i := 0; i < decisions; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	logged := strings.Count(log.String(), "\n")
+	if logged < decisions/5 || logged > decisions*3/10 {
+		t.Fatalf("logged %d of %d decisions at a sample rate of 0.25, want about %d", logged, decisions, decisions/4)
+	}
+}
+
+func TestShadowMirrorsAdmittedRequestsIndependently(t *testing.T) {
+	primary := newTestBucket(5, 1, 1)
+	shadow := newTestBucket(3, 1, 1)
+	shadow.name = "Shadow Bucket"
+	primary.shadow = shadow
+	for i := 0; i < 7; i++ {
+		primary.tryAdd(request{requestType: fmt.Sprintf("Request %d", i), requestedAt: time.Now()})
+	}
+
+	primaryStats, shadowStats := primary.stats(), shadow.stats()
+	if primaryStats.depth != 5 || primaryStats.dropped != 2 {
+		t.Errorf("primary depth %d and dropped %d, want 5 and 2", primaryStats.depth, primaryStats.dropped)
+	}
+	// Only the 5 requests the primary admitted are mirrored, and the shadow drops what it cannot fit.
+	if shadowStats.admitted != 3 || shadowStats.dropped != 2 {
+		t.Errorf("shadow admitted %d and dropped %d, want 3 and 2", shadowStats.admitted, shadowStats.dropped)
+	}
+	mirrored := shadow.extract()
+	for i, req := range mirrored {
+		if want := fmt.Sprintf("Request %d", i); req.requestType != want {
+			t.Errorf("shadow request %d = %s, want %s", i, req.requestType, want)
+		}
+	}
+	if after := primary.stats(); after.depth != 5 || after.dropped != 2 {
+		t.Errorf("emptying the shadow changed the primary to depth %d and dropped %d", after.depth, after.dropped)
+	}
+}
+
+func TestRetiringWorkersAreReplacedAtWorkerMin(t *testing.T) {
+	bucket := newTestBucket(10, 4, 2)
+	bucket.workerLifetime = 20 * time.Millisecond
+	for i := 0; i < 2; i++ {
+		spawnWorker(bucket)
+	}
+	for deadline := time.Now().Add(200 * time.Millisecond); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if workers := bucket.workerCount(); workers < bucket.workerMin {
+			t.Fatalf("pool dropped to %d workers, below workerMin %d", workers, bucket.workerMin)
+		}
+	}
+	bucket.mu.Lock()
+	registered := bucket.workersRegistered
+	bucket.mu.Unlock()
+	if registered < 10 {
+		t.Fatalf("%d workers ever joined the pool, want retiring workers to have been replaced repeatedly", registered)
+	}
+	shutdownTestBucket(t, bucket)
+}
+
+func TestIdleWorkerPicksUpRequestsPromptly(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	processed := make(chan time.Time, 5)
+	bucket.setProcess(func(batch []request) { processed <- time.Now() })
+	spawnWorker(bucket)
+	for i := 0; i < 5; i++ {
+		// Let the worker settle into waiting on an empty bucket before the request arrives.
+		time.Sleep(10 * time.Millisecond)
+		added := time.Now()
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: added})
+		select {
+		case at := <-processed:
+			if delay := at.Sub(added); delay > 20*time.Millisecond {
+				t.Errorf("request %d was picked up %s after arriving, want it picked up promptly", i, delay)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("request %d was not processed", i)
+		}
+	}
+	shutdownTestBucket(t, bucket)
+}
+
+func TestDryRunValidatesWithoutProcessing(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	bucket.dryRun = true
+	var mu sync.Mutex
+	validated := 0
+	bucket.validate = func(req request) error {
+		mu.Lock()
+		defer mu.Unlock()
+		validated++
+		if req.requestType == "Bad Request" {
+			return errors.New("unknown request type")
+		}
+		return nil
+	}
+	worked := false
+	bucket.setProcess(func(batch []request) { worked = true })
+	for _, requestType := range []string{"HTML Request", "Bad Request", "HTML Request"} {
+		bucket.tryAdd(request{requestType: requestType, requestedAt: time.Now()})
+	}
+	spawnWorker(bucket)
+	waitFor(t, time.Second, "every request to be processed", func() bool { return bucket.stats().processed == 3 })
+	shutdownTestBucket(t, bucket)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if validated != 3 {
+		t.Errorf("validator ran %d times, want once per request", validated)
+	}
+	if worked {
+		t.Error("the process function ran in dry run mode")
+	}
+}
+
+func TestThresholdAlertsFireOncePerCrossing(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	bucket.alertLevels = []alertLevel{{name: "warn", fraction: 0.5}, {name: "critical", fraction: 0.8}}
+	bucket.alertHysteresis = 0.15
+	var fired []string
+	bucket.onThreshold = func(level string, depth int) { fired = append(fired, fmt.Sprintf("%s@%d", level, depth)) }
+
+	// Fill to capacity, then drain to empty, hovering around the warn level on the way down.
+	for i := 0; i < 10; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	drain := func(count int) {
+		for i := 0; i < count; i++ {
+			bucket.dequeued(<-bucket.receiveChannel(), false)
+		}
+	}
+	drain(6)
+	bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	drain(5)
+
+	want := []string{"warn@5", "critical@8", "warn@6", "ok@3"}
+	if strings.Join(fired, " ") != strings.Join(want, " ") {
+		t.Fatalf("alerts fired %v, want %v", fired, want)
+	}
+}
+
+func TestLittlesLawHoldsUnderSteadyLoad(t *testing.T) {
+	bucket := newTestBucket(50, 2, 2)
+	bucket.processingTime = 5 * time.Millisecond
+	for i := 0; i < 2; i++ {
+		spawnWorker(bucket)
+	}
+	for i := 0; i < 100; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+		time.Sleep(4 * time.Millisecond)
+	}
+	waitFor(t, 2*time.Second, "the load to drain", func() bool { return bucket.quiesced() })
+
+	L, lambda, W := bucket.littlesLaw()
+	if L <= 0 || lambda <= 0 || W <= 0 {
+		t.Fatalf("littlesLaw = %v, %v, %v, want positive values", L, lambda, W)
+	}
+	if diff := math.Abs(L-lambda*W) / L; diff > 0.2 {
+		t.Fatalf("L = %.3f but lambda * W = %.3f * %.4f = %.3f, want them within 20%%", L, lambda, W, lambda*W)
+	}
+	shutdownTestBucket(t, bucket)
+}
+
+func TestAddsRacingShutdownAreDrainedOrRefused(t *testing.T) {
+	bucket := newTestBucket(20, 2, 2)
+	for i := 0; i < 2; i++ {
+		spawnWorker(bucket)
+	}
+	var admitted atomic.Int64
+	var producers sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			for {
+				switch err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); {
+				case err == nil:
+					admitted.Add(1)
+				case errors.Is(err, errShutdown):
+					return
+				}
+			}
+		}()
+	}
+	waitFor(t, time.Second, "some requests to be admitted", func() bool { return admitted.Load() > 50 })
+	shutdownTestBucket(t, bucket)
+	producers.Wait()
+
+	if processed := bucket.stats().processed; processed != uint64(admitted.Load()) {
+		t.Fatalf("processed %d of the %d requests admitted before shutdown, want all of them", processed, admitted.Load())
+	}
+	if err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); !errors.Is(err, errShutdown) {
+		t.Fatalf("tryAdd after shutdown = %v, want errShutdown", err)
+	}
+}
+
+func TestScaleReactionIsWithinScaleInterval(t *testing.T) {
+	bucket := newTestBucket(20, 4, 1)
+	bucket.scaleInterval = 50 * time.Millisecond
+	unblock := make(chan struct{})
+	bucket.setProcess(func(batch []request) { <-unblock })
+	go workerPoolSizeAdjuster(bucket)
+	time.Sleep(20 * time.Millisecond)
+
+	// Saturate the bucket at once, so the depth crosses the high watermark between two evaluations.
+	for i := 0; i < 20; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	waitFor(t, time.Second, "the pool to scale up", func() bool { return bucket.stats().scaleReaction > 0 })
+
+	// Allow a little scheduling slack on top of scaleInterval for the ticker to be serviced.
+	limit := bucket.scaleInterval + 10*time.Millisecond
+	if reaction := bucket.stats().maxScaleReaction; reaction > limit {
+		t.Fatalf("the pool took %s to react to saturation, want within %s", reaction, limit)
+	}
+	close(unblock)
+	shutdownTestBucket(t, bucket)
+}
+
+func TestRetryClonesWithAFreshTimestamp(t *testing.T) {
+	original := request{
+		requestType: "HTML Request",
+		requestedAt: time.Now().Add(-time.Minute),
+		sequence:    7,
+		attempts:    1,
+		key:         "user-1",
+		source:      "host-a",
+	}
+	before := original
+	retried := original.retry()
+
+	if original != before {
+		t.Fatalf("retry changed the original request to %+v", original)
+	}
+	if retried.attempts != 2 {
+		t.Fatalf("retried request has %d attempts, want 2", retried.attempts)
+	}
+	if !retried.requestedAt.After(original.requestedAt) || time.Since(retried.requestedAt) > time.Second {
+		t.Fatalf("retried request was requested at %s, want a fresh timestamp", retried.requestedAt)
+	}
+	retried.requestedAt, retried.attempts, retried.skewCorrected = original.requestedAt, original.attempts, original.skewCorrected
+	if retried != original {
+		t.Fatalf("retry changed other fields: got %+v, want %+v", retried, original)
+	}
+}
+
+// assertNoLeaks runs fn against bucket, shuts bucket down, and fails the test if more Go routines are
+// left running than before fn started. Exiting Go routines can take a moment to be reaped after
+// shutdown returns, so the count is rechecked with short waits before the test fails.
+func assertNoLeaks(t *testing.T, bucket *leakyBucket, fn func()) {
+	t.Helper()
+	baseline := runtime.NumGoroutine()
+	fn()
+	shutdownTestBucket(t, bucket)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		running := runtime.NumGoroutine()
+		if running <= baseline {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d Go routines running after shutdown, want at most %d:\n%s", running, baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartAndShutdownLeaveNoGoroutines(t *testing.T) {
+	bucket := newTestBucket(50, 4, 2)
+	bucket.scaleInterval = 10 * time.Millisecond
+	assertNoLeaks(t, bucket, func() {
+		for i := 0; i < bucket.workerMin; i++ {
+			spawnWorker(bucket)
+		}
+		go workerPoolSizeAdjuster(bucket)
+		for i := 0; i < 100; i++ {
+			bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+		}
+		waitFor(t, 2*time.Second, "the load to drain", func() bool { return bucket.quiesced() })
+	})
+}
+
+func TestPolicyRoundTripsThroughStats(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	p := policy{limits: "10 queued requests, 1 worker", owner: "Web Team", contact: "web@example.com", sla: "99.9% within 1s"}
+	bucket.setPolicy(p)
+	if got := bucket.currentPolicy(); got != p {
+		t.Fatalf("currentPolicy() = %+v, want %+v", got, p)
+	}
+	if got := bucket.stats().policy; got != p {
+		t.Fatalf("stats().policy = %+v, want %+v", got, p)
+	}
+}
+
+func TestLeakGatePacesStartsDespiteIdleWorkers(t *testing.T) {
+	bucket := newTestBucket(10, 4, 4)
+	const interval = 20 * time.Millisecond
+	var mu sync.Mutex
+	var starts []time.Time
+	bucket.setProcess(func(batch []request) {
+		mu.Lock()
+		defer mu.Unlock()
+		for range batch {
+			starts = append(starts, time.Now())
+		}
+	})
+	bucket.startLeakGate(interval)
+	for i := 0; i < 4; i++ {
+		spawnWorker(bucket)
+	}
+	for i := 0; i < 6; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	waitFor(t, 2*time.Second, "the gate to leak every request", func() bool { return bucket.stats().processed == 6 })
+	shutdownTestBucket(t, bucket)
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	for i := 1; i < len(starts); i++ {
+		// Allow for the process function being called a moment after the gate releases the request.
+		if gap := starts[i].Sub(starts[i-1]); gap < interval-5*time.Millisecond {
+			t.Errorf("processing starts %d and %d were %s apart, want about %s", i-1, i, gap, interval)
+		}
+	}
+}
+
+func TestDropsByReasonCountsEachCauseSeparately(t *testing.T) {
+	bucket := newTestBucket(3, 1, 1)
+	bucket.keyLimit = 1
+	add := func(requestType string, key string) error {
+		return bucket.tryAdd(request{requestType: requestType, requestedAt: time.Now(), key: key})
+	}
+
+	if err := bucket.pauseType("Image Request"); err != nil {
+		t.Fatalf("pauseType = %v, want nil", err)
+	}
+	add("Image Request", "")
+	add("Image Request", "")
+	add("HTML Request", "user-1")
+	add("HTML Request", "user-1")
+	add("HTML Request", "")
+	add("HTML Request", "")
+	add("HTML Request", "")
+	add("HTML Request", "")
+	add("HTML Request", "")
+	// A worker drains the queue so the bucket can shut down.
+	spawnWorker(bucket)
+	shutdownTestBucket(t, bucket)
+	add("HTML Request", "")
+
+	want := map[string]uint64{"type_paused": 2, "key_limit": 1, "full": 3, "shutdown": 1}
+	got := bucket.dropsByReason()
+	if len(got) != len(want) {
+		t.Fatalf("dropsByReason() = %v, want %v", got, want)
+	}
+	for reason, count := range want {
+		if got[reason] != count {
+			t.Errorf("%d requests dropped as %q, want %d", got[reason], reason, count)
+		}
+	}
+	if dropped := bucket.stats().dropped; dropped != 7 {
+		t.Errorf("%d requests dropped in total, want 7", dropped)
+	}
+}
+
+func TestProducerStopsBackingOffOnShutdown(t *testing.T) {
+	bucket := newTestBucket(1, 1, 1)
+	bucket.producerBackoff = constantBackoff{delay: time.Minute}
+	unblock := make(chan struct{})
+	bucket.setProcess(func(batch []request) { <-unblock })
+	spawnWorker(bucket)
+	// Fill the bucket behind a busy worker, so the producer's first request is refused.
+	bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	waitFor(t, time.Second, "the worker to pick up the request", func() bool { return bucket.inFlight.Load() == 1 })
+	bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		receiveRequests(bucket)
+	}()
+	waitFor(t, time.Second, "the producer to be refused", func() bool { return bucket.stats().dropped > 0 })
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		shutdownTestBucket(t, bucket)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("the producer was still backing off a second after shutdown started")
+	}
+	close(unblock)
+	<-shutdownDone
+}
+
+func TestShutdownAllDrainsAShadowAfterItsPrimary(t *testing.T) {
+	primary := newTestBucket(20, 2, 2)
+	secondary := newTestBucket(1000, 2, 2)
+	primary.shadow = secondary
+	for _, bucket := range []*leakyBucket{primary, secondary} {
+		for i := 0; i < 2; i++ {
+			spawnWorker(bucket)
+		}
+	}
+
+	// Once the shadow starts shutting down, the primary must already have stopped.
+	primaryStoppedFirst := make(chan bool, 1)
+	go func() {
+		<-secondary.closing
+		select {
+		case <-primary.stopped:
+			primaryStoppedFirst <- true
+		default:
+			primaryStoppedFirst <- false
+		}
+	}()
+
+	var admitted atomic.Int64
+	producerDone := make(chan struct{})
+	go func() {
+		defer close(producerDone)
+		for {
+			switch err := primary.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); {
+			case err == nil:
+				admitted.Add(1)
+			case errors.Is(err, errShutdown):
+				return
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	waitFor(t, time.Second, "some requests to be admitted", func() bool { return admitted.Load() > 50 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Listing the shadow first checks that the order comes from the dependency, not the slice.
+	if err := shutdownAll(ctx, []*leakyBucket{secondary, primary}); err != nil {
+		t.Fatalf("shutdownAll: %v", err)
+	}
+	<-producerDone
+
+	if !<-primaryStoppedFirst {
+		t.Fatal("the shadow started shutting down before its primary had stopped")
+	}
+	if processed := primary.stats().processed; processed != uint64(admitted.Load()) {
+		t.Fatalf("primary processed %d of the %d requests it admitted", processed, admitted.Load())
+	}
+	if processed := secondary.stats().processed; processed != uint64(admitted.Load()) {
+		t.Fatalf("shadow processed %d of the %d requests mirrored to it", processed, admitted.Load())
+	}
+}
+
+func TestShutdownAllRefusesACycle(t *testing.T) {
+	a := newTestBucket(10, 1, 1)
+	b := newTestBucket(10, 1, 1)
+	a.shadow, b.shadow = b, a
+	if err := shutdownAll(context.Background(), []*leakyBucket{a, b}); err == nil {
+		t.Fatal("shutdownAll with buckets shadowing each other succeeded, want a cycle error")
+	}
+	for _, bucket := range []*leakyBucket{a, b} {
+		select {
+		case <-bucket.closing:
+			t.Fatal("shutdownAll started shutting down a bucket despite the cycle")
+		default:
+		}
+	}
+}
+
+func TestWorstCaseWaitBoundsASimulatedBurst(t *testing.T) {
+	bucket := newTestBucket(20, 2, 2)
+	bucket.processingTime = 20 * time.Millisecond
+	var mu sync.Mutex
+	started := make(map[uint64]time.Time)
+	bucket.setProcess(func(batch []request) {
+		mu.Lock()
+		for _, req := range batch {
+			started[req.sequence] = time.Now()
+		}
+		mu.Unlock()
+		time.Sleep(bucket.processingTime)
+	})
+	for i := 0; i < 2; i++ {
+		spawnWorker(bucket)
+	}
+
+	const burst = 9
+	estimate := bucket.worstCaseWait(burst)
+	arrived := time.Now()
+	for i := 0; i < burst; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: arrived})
+	}
+	waitFor(t, 2*time.Second, "the burst to be processed", func() bool { return bucket.stats().processed == burst })
+	shutdownTestBucket(t, bucket)
+
+	mu.Lock()
+	defer mu.Unlock()
+	wait := started[burst-1].Sub(arrived)
+	// The workers were idle rather than just starting a request, so the burst waits up to one service time
+	// less than the worst case. Allow a little scheduling slack on either side.
+	if wait > estimate+10*time.Millisecond || wait < estimate-bucket.processingTime-10*time.Millisecond {
+		t.Fatalf("the last request of the burst waited %s, want within a service time below the estimate %s", wait, estimate)
+	}
+}
+
+func TestCompactionProcessesOnlyTheLatestRequestPerKey(t *testing.T) {
+	bucket := newTestBucket(20, 1, 1)
+	bucket.compactByKey = true
+	var mu sync.Mutex
+	var processed []request
+	bucket.setProcess(func(batch []request) {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, batch...)
+	})
+	for i := 0; i < 3; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now(), key: "user-1", attempts: i})
+	}
+	bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now(), key: "user-2"})
+	bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	spawnWorker(bucket)
+	waitFor(t, 2*time.Second, "the queue to drain", func() bool { return bucket.quiesced() })
+	shutdownTestBucket(t, bucket)
+
+	mu.Lock()
+	defer mu.Unlock()
+	perKey := make(map[string][]request)
+	for _, req := range processed {
+		perKey[req.key] = append(perKey[req.key], req)
+	}
+	if reqs := perKey["user-1"]; len(reqs) != 1 || reqs[0].attempts != 2 {
+		t.Fatalf("processed %+v for user-1, want only its latest request", reqs)
+	}
+	if len(perKey["user-2"]) != 1 || len(perKey[""]) != 2 {
+		t.Fatalf("processed %d requests for user-2 and %d without a key, want 1 and 2", len(perKey["user-2"]), len(perKey[""]))
+	}
+	if superseded := bucket.leftByReason()["superseded"]; superseded != 2 {
+		t.Fatalf("%d requests left the bucket as superseded, want 2", superseded)
+	}
+	// Superseded requests were admitted, so they leave the bucket rather than count as dropped.
+	stats := bucket.stats()
+	if stats.dropped != 0 || len(stats.dropsByReason) != 0 {
+		t.Fatalf("%d requests dropped by reason %v, want superseded requests not counted as dropped", stats.dropped, stats.dropsByReason)
+	}
+	if stats.admitted != uint64(stats.depth)+uint64(stats.inFlight)+stats.processed+stats.left {
+		t.Fatalf("admitted %d, want depth %d + in flight %d + processed %d + left %d",
+			stats.admitted, stats.depth, stats.inFlight, stats.processed, stats.left)
+	}
+}
+
+func TestLeakBurstAllowanceIsSavedWhileIdle(t *testing.T) {
+	bucket := newTestBucket(20, 2, 2)
+	bucket.leakBurst = 3
+	const interval = 50 * time.Millisecond
+	bucket.startLeakGate(interval)
+	for i := 0; i < 2; i++ {
+		spawnWorker(bucket)
+	}
+	// Idle for more intervals than leakBurst, so the allowance saves up to its cap.
+	time.Sleep(6 * interval)
+	for i := 0; i < 10; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	waitFor(t, 2*interval, "the first release", func() bool { return bucket.stats().processed > 0 })
+	time.Sleep(interval / 5)
+	if processed := bucket.stats().processed; processed != uint64(1+bucket.leakBurst) {
+		t.Fatalf("%d requests processed in the first interval after idling, want 1 plus the allowance of %d", processed, bucket.leakBurst)
+	}
+	waitFor(t, 2*time.Second, "the rest of the burst to leak", func() bool { return bucket.stats().processed == 10 })
+	shutdownTestBucket(t, bucket)
+}
+
+func TestWarmPoolRunsWorkersOnParkedGoRoutines(t *testing.T) {
+	const spawns = 5
+	var mu sync.Mutex
+	launched := make(map[string]int)
+	countLaunches := func(name string, fn func()) {
+		mu.Lock()
+		launched[name]++
+		mu.Unlock()
+		go fn()
+	}
+	warm := newTestBucket(10, spawns, 1)
+	warm.launch = countLaunches
+	warm.startWarmPool(2)
+	waitFor(t, time.Second, "the warm pool to park", func() bool { return warm.stats().warmPool == 2 })
+	if workers := warm.workerCount(); workers != 0 {
+		t.Fatalf("the warm pool counts as %d workers before any are activated, want 0", workers)
+	}
+
+	for i := 0; i < spawns; i++ {
+		// The pool refills lazily, so wait for the last activation's replacement to park.
+		waitFor(t, time.Second, "the warm pool to refill", func() bool { return warm.stats().warmPool == 2 })
+		spawnWorker(warm)
+		waitFor(t, time.Second, "the worker to start", func() bool { return warm.stats().warmActivations == uint64(i+1) })
+	}
+	if workers := warm.workerCount(); workers != spawns {
+		t.Fatalf("the warm bucket has %d workers, want %d", workers, spawns)
+	}
+	mu.Lock()
+	if len(launched) != 1 || launched["a parked worker"] != 2+spawns {
+		t.Fatalf("the warm bucket launched %v, want only the 2 parked Go routines and a replacement for each of the %d activations", launched, spawns)
+	}
+	mu.Unlock()
+	shutdownTestBucket(t, warm)
+
+	// Without a warm pool, each spawned worker gets a Go routine of its own.
+	mu.Lock()
+	launched = make(map[string]int)
+	mu.Unlock()
+	cold := newTestBucket(10, spawns, 1)
+	cold.launch = countLaunches
+	for i := 0; i < spawns; i++ {
+		spawnWorker(cold)
+	}
+	waitFor(t, time.Second, "the cold workers to start", func() bool { return cold.stats().activationLatency > 0 })
+	mu.Lock()
+	if len(launched) != spawns || launched["a parked worker"] != 0 {
+		t.Fatalf("the cold bucket launched %v, want a Go routine for each of the %d workers", launched, spawns)
+	}
+	mu.Unlock()
+	if activations := cold.stats().warmActivations; activations != 0 {
+		t.Fatalf("%d cold workers were counted as warm activations, want 0", activations)
+	}
+	shutdownTestBucket(t, cold)
+}
+
+func TestLeakGateConsumesEachRequestOnce(t *testing.T) {
+	bucket := newTestBucket(10, 3, 3)
+	var mu sync.Mutex
+	seen := make(map[uint64]int)
+	bucket.setProcess(func(batch []request) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, req := range batch {
+			seen[req.sequence]++
+		}
+	})
+	bucket.startLeakGate(time.Millisecond)
+	for i := 0; i < 3; i++ {
+		spawnWorker(bucket)
+	}
+	admitted := 0
+	for i := 0; i < 100; i++ {
+		if bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}) == nil {
+			admitted++
+		}
+		time.Sleep(200 * time.Microsecond)
+	}
+	shutdownTestBucket(t, bucket)
+
+	mu.Lock()
+	defer mu.Unlock()
+	stats := bucket.stats()
+	if len(seen) != admitted || stats.processed != uint64(admitted) {
+		t.Fatalf("processed %d distinct requests, %d in total, of the %d admitted", len(seen), stats.processed, admitted)
+	}
+	for sequence, times := range seen {
+		if times != 1 {
+			t.Errorf("request %d was processed %d times, want once", sequence, times)
+		}
+	}
+	if stats.left != 0 {
+		t.Errorf("%d requests left the bucket without being processed, want none", stats.left)
+	}
+}
+
+func TestOnlineEstimatesConvergeOnObservedTimes(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	bucket.processingTime = 100 * time.Millisecond
+	bucket.estimateWeight = 0.5
+	bucket.setProcess(func(batch []request) { time.Sleep(5 * time.Millisecond) })
+	spawnWorker(bucket)
+
+	previous := bucket.expectedServiceTime("Image Request")
+	for i := 1; i <= 6; i++ {
+		bucket.tryAdd(request{requestType: "Image Request", requestedAt: time.Now()})
+		waitFor(t, time.Second, "the request to be processed", func() bool { return bucket.stats().processed == uint64(i) })
+		estimate := bucket.expectedServiceTime("Image Request")
+		if estimate >= previous {
+			t.Fatalf("after %d completions the estimate is %s, want it below the previous %s", i, estimate, previous)
+		}
+		previous = estimate
+	}
+	if previous > 15*time.Millisecond {
+		t.Fatalf("estimate is %s after six completions of about 5ms, want it near 5ms", previous)
+	}
+	if other := bucket.expectedServiceTime("HTML Request"); other != bucket.processingTime {
+		t.Fatalf("an unobserved type is estimated at %s, want the configured %s", other, bucket.processingTime)
+	}
+	shutdownTestBucket(t, bucket)
+}
+
+func TestPrefillSpreadsTimestampsOverTheWindow(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	bucket.prefillSpread = 5 * time.Second
+	before := time.Now()
+	bucket.prefill("Login Attempt", 5)
+	after := time.Now()
+
+	prefilled := bucket.swapQueue(nil)
+	if len(prefilled) != 5 {
+		t.Fatalf("prefill queued %d requests, want 5", len(prefilled))
+	}
+	for i, req := range prefilled {
+		if req.requestedAt.Before(before.Add(-bucket.prefillSpread)) || req.requestedAt.After(after) {
+			t.Errorf("request %d was requested at %s, want within %s before prefilling", i, req.requestedAt, bucket.prefillSpread)
+		}
+		if i > 0 {
+			if gap := req.requestedAt.Sub(prefilled[i-1].requestedAt); gap != time.Second {
+				t.Errorf("requests %d and %d were requested %s apart, want an even spread of 1s", i-1, i, gap)
+			}
+		}
+	}
+}
+
+func TestReporterReportsEveryBucketUntilShutdown(t *testing.T) {
+	web := newTestBucket(10, 1, 1)
+	web.name = "Web"
+	api := newTestBucket(10, 1, 1)
+	api.name = "API"
+	for i := 0; i < 3; i++ {
+		web.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	api.tryAdd(request{requestType: "API Request", requestedAt: time.Now()})
+
+	const interval = 20 * time.Millisecond
+	var mu sync.Mutex
+	var reports []map[string]bucketStats
+	var reportedAt []time.Time
+	started := time.Now()
+	stop := startReporter([]*leakyBucket{web, api}, interval, func(current map[string]bucketStats) {
+		mu.Lock()
+		defer mu.Unlock()
+		reports = append(reports, current)
+		reportedAt = append(reportedAt, time.Now())
+	})
+	defer stop()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(reports)
+	}
+	waitFor(t, time.Second, "three reports", func() bool { return count() >= 3 })
+
+	mu.Lock()
+	if elapsed := reportedAt[2].Sub(started); elapsed < 3*interval-5*time.Millisecond {
+		t.Errorf("three reports arrived within %s, want one every %s", elapsed, interval)
+	}
+	if depth := reports[0]["Web"].depth; depth != 3 {
+		t.Errorf("the report shows Web at depth %d, want 3", depth)
+	}
+	if depth := reports[0]["API"].depth; depth != 1 {
+		t.Errorf("the report shows API at depth %d, want 1", depth)
+	}
+	mu.Unlock()
+
+	spawnWorker(web)
+	spawnWorker(api)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownAll(ctx, []*leakyBucket{web, api}); err != nil {
+		t.Fatalf("shutdownAll: %v", err)
+	}
+	// A report may already be underway as the buckets stop, so allow one more before checking none follow.
+	time.Sleep(2 * interval)
+	stopped := count()
+	time.Sleep(3 * interval)
+	if reported := count(); reported != stopped {
+		t.Fatalf("%d reports arrived after every bucket was shut down, want none", reported-stopped)
+	}
+}
+
+func TestDepthAndCapacityReportTheQueue(t *testing.T) {
+	bucket := newTestBucket(5, 1, 1)
+	if bucket.depth() != 0 || bucket.capacity() != 5 {
+		t.Fatalf("an empty bucket reports depth %d and capacity %d, want 0 and 5", bucket.depth(), bucket.capacity())
+	}
+	for i := 0; i < 7; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	stats := bucket.stats()
+	if bucket.depth() != 5 || stats.depth != 5 || stats.capacity != 5 {
+		t.Fatalf("a full bucket reports depth %d, stats depth %d, and capacity %d, want 5, 5, and 5", bucket.depth(), stats.depth, stats.capacity)
+	}
+
+	// A request taken by a worker is in flight, no longer queued.
+	unblock := make(chan struct{})
+	bucket.setProcess(func(batch []request) { <-unblock })
+	spawnWorker(bucket)
+	waitFor(t, time.Second, "a request to be in flight", func() bool { return bucket.inFlight.Load() == 1 })
+	if bucket.depth() != 4 || bucket.capacity() != 5 {
+		t.Fatalf("with one request in flight the bucket reports depth %d and capacity %d, want 4 and 5", bucket.depth(), bucket.capacity())
+	}
+	close(unblock)
+	shutdownTestBucket(t, bucket)
+}
+
+func TestMemoryPressureShedsAndPausesIntake(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	var pressure atomic.Bool
+	pressure.Store(true)
+	bucket.memoryPressure = pressure.Load
+	bucket.pressureShed = 0.5
+	bucket.pressurePause = 50 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+
+	bucket.relievePressure()
+	if depth := bucket.depth(); depth != 5 {
+		t.Fatalf("%d requests queued after shedding half of 10, want 5", depth)
+	}
+	if shed := bucket.leftByReason()["memory_pressure"]; shed != 5 {
+		t.Fatalf("%d requests left the bucket for memory pressure, want 5", shed)
+	}
+	// Shed requests were admitted, so they leave the bucket rather than count as dropped.
+	stats := bucket.stats()
+	if stats.dropped != 0 || stats.left != 5 {
+		t.Fatalf("%d requests dropped and %d left after shedding 5, want 0 and 5", stats.dropped, stats.left)
+	}
+	if stats.admitted != uint64(stats.depth)+uint64(stats.inFlight)+stats.processed+stats.left {
+		t.Fatalf("admitted %d, want depth %d + in flight %d + processed %d + left %d",
+			stats.admitted, stats.depth, stats.inFlight, stats.processed, stats.left)
+	}
+	if err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); !errors.Is(err, errMemoryPressure) {
+		t.Fatalf("tryAdd while intake is paused = %v, want errMemoryPressure", err)
+	}
+
+	pressure.Store(false)
+	time.Sleep(bucket.pressurePause)
+	bucket.relievePressure()
+	if err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); err != nil {
+		t.Fatalf("tryAdd once pressure cleared and the pause ran out = %v, want it admitted", err)
+	}
+	if depth := bucket.depth(); depth != 6 {
+		t.Fatalf("%d requests queued once pressure cleared, want 6", depth)
+	}
+}
+
+func TestWorkerBudgetParksAWorkerForOthersToPickUp(t *testing.T) {
+	bucket := newTestBucket(10, 2, 1)
+	bucket.workerBudget = 2
+	bucket.budgetRefill = 200 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+
+	spawnWorker(bucket)
+	waitFor(t, time.Second, "the first worker to spend its budget", func() bool { return bucket.stats().processed == 2 })
+	time.Sleep(20 * time.Millisecond)
+	if processed, depth := bucket.stats().processed, bucket.depth(); processed != 2 || depth != 3 {
+		t.Fatalf("the parked worker left %d processed and %d queued, want 2 and 3", processed, depth)
+	}
+
+	spawnWorker(bucket)
+	waitFor(t, time.Second, "the second worker to pick up the slack", func() bool { return bucket.stats().processed == 4 })
+	if depth := bucket.depth(); depth != 1 {
+		t.Fatalf("%d requests queued once both workers spent their budgets, want 1", depth)
+	}
+	// The last request is processed once a budget refills.
+	shutdownTestBucket(t, bucket)
+}
+
+func TestQueueCompositionTracksQueuedTypes(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	for _, requestType := range []string{"HTML Request", "Image Request", "HTML Request", "Image Request", "HTML Request"} {
+		bucket.tryAdd(request{requestType: requestType, requestedAt: time.Now()})
+	}
+	want := map[string]int{"HTML Request": 3, "Image Request": 2}
+	if got := bucket.queueComposition(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("queueComposition() = %v, want %v", got, want)
+	}
+
+	unblock := make(chan struct{})
+	bucket.setProcess(func(batch []request) { <-unblock })
+	spawnWorker(bucket)
+	waitFor(t, time.Second, "the first request to be in flight", func() bool { return bucket.inFlight.Load() == 1 })
+	want = map[string]int{"HTML Request": 2, "Image Request": 2}
+	if got := bucket.queueComposition(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("queueComposition() with the first request in flight = %v, want %v", got, want)
+	}
+
+	close(unblock)
+	waitFor(t, time.Second, "the queue to drain", func() bool { return bucket.quiesced() })
+	if got := bucket.queueComposition(); len(got) != 0 {
+		t.Fatalf("queueComposition() of a drained bucket = %v, want it empty", got)
+	}
+	shutdownTestBucket(t, bucket)
+}
+
+func TestHandoverKeepsALoadedBucketProcessing(t *testing.T) {
+	bucket := newTestBucket(50, 4, 1)
+	bucket.processingTime = 5 * time.Millisecond
+	bucket.scaleInterval = 10 * time.Millisecond
+	spawnWorker(bucket)
+	go workerPoolSizeAdjuster(bucket)
+	waitFor(t, time.Second, "the adjuster to start", func() bool { return bucket.adjusting.Load() })
+
+	var admitted atomic.Int64
+	producerDone := make(chan struct{})
+	go func() {
+		defer close(producerDone)
+		for {
+			switch err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); {
+			case err == nil:
+				admitted.Add(1)
+			case errors.Is(err, errShutdown):
+				return
+			}
+			time.Sleep(200 * time.Microsecond)
+		}
+	}()
+	waitFor(t, time.Second, "the bucket to load up", func() bool { return bucket.depth() > 5 })
+
+	if !bucket.handover() {
+		t.Fatal("handover of a running adjuster returned false")
+	}
+	if bucket.adjusting.Load() {
+		t.Fatal("the old adjuster is still running after handover")
+	}
+	if workers := bucket.workerCount(); workers == 0 {
+		t.Fatal("handover stopped the workers, want them left processing")
+	}
+	processed := bucket.stats().processed
+	waitFor(t, time.Second, "processing to continue during handover", func() bool { return bucket.stats().processed > processed })
+
+	go workerPoolSizeAdjuster(bucket)
+	waitFor(t, time.Second, "the new adjuster to start", func() bool { return bucket.adjusting.Load() })
+	shutdownTestBucket(t, bucket)
+	<-producerDone
+	if processed := bucket.stats().processed; processed != uint64(admitted.Load()) {
+		t.Fatalf("processed %d of the %d requests admitted across the handover, want all of them", processed, admitted.Load())
+	}
+}
+
+func TestTimeToEmptyEstimatesTheDrainTime(t *testing.T) {
+	bucket := newTestBucket(20, 2, 2)
+	bucket.processingTime = 20 * time.Millisecond
+	if estimate := bucket.timeToEmpty(); estimate != 0 {
+		t.Fatalf("timeToEmpty() of an empty bucket = %s, want 0", estimate)
+	}
+	unblock := make(chan struct{})
+	bucket.setProcess(func(batch []request) {
+		<-unblock
+		time.Sleep(bucket.processingTime)
+	})
+	for i := 0; i < 2; i++ {
+		spawnWorker(bucket)
+	}
+	for i := 0; i < 10; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	waitFor(t, time.Second, "both workers to take a request", func() bool { return bucket.inFlight.Load() == 2 })
+
+	// Eight queued and two in flight across two workers is five rounds of processing.
+	estimate := bucket.timeToEmpty()
+	if want := 5 * bucket.processingTime; estimate != want {
+		t.Fatalf("timeToEmpty() = %s, want %s", estimate, want)
+	}
+	started := time.Now()
+	close(unblock)
+	waitFor(t, 2*time.Second, "the backlog to drain", func() bool { return bucket.quiesced() })
+	if drained := time.Since(started); drained < estimate-10*time.Millisecond || drained > estimate+30*time.Millisecond {
+		t.Fatalf("the backlog drained in %s, want within tolerance of the estimate %s", drained, estimate)
+	}
+	shutdownTestBucket(t, bucket)
+}
+
+func TestPausedTypesAreHeldUntilResumed(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	bucket.holdPaused = true
+	if err := bucket.pauseType("Image Request"); err != nil {
+		t.Fatalf("pauseType = %v, want nil", err)
+	}
+	spawnWorker(bucket)
+	for _, requestType := range []string{"Image Request", "HTML Request", "Image Request", "HTML Request"} {
+		if err := bucket.tryAdd(request{requestType: requestType, requestedAt: time.Now()}); err != nil {
+			t.Fatalf("tryAdd of a %s while holding paused types = %v, want it admitted", requestType, err)
+		}
+	}
+	waitFor(t, time.Second, "the HTML requests to be processed", func() bool {
+		return bucket.processedByType()["HTML Request"] == 2
+	})
+	time.Sleep(20 * time.Millisecond)
+	if images := bucket.processedByType()["Image Request"]; images != 0 {
+		t.Fatalf("%d paused Image Requests were processed, want them held", images)
+	}
+
+	bucket.resumeType("Image Request")
+	waitFor(t, time.Second, "the held Image Requests to be processed", func() bool {
+		return bucket.processedByType()["Image Request"] == 2
+	})
+	shutdownTestBucket(t, bucket)
+}
+
+func TestPausedTypesAreRefusedWithoutHolding(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	if err := bucket.pauseType("Image Request"); err != nil {
+		t.Fatalf("pauseType = %v, want nil", err)
+	}
+	if err := bucket.tryAdd(request{requestType: "Image Request", requestedAt: time.Now()}); !errors.Is(err, errTypePaused) {
+		t.Fatalf("tryAdd of a paused type = %v, want errTypePaused", err)
+	}
+	if err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); err != nil {
+		t.Fatalf("tryAdd of another type = %v, want it admitted", err)
+	}
+	bucket.resumeType("Image Request")
+	if err := bucket.tryAdd(request{requestType: "Image Request", requestedAt: time.Now()}); err != nil {
+		t.Fatalf("tryAdd of a resumed type = %v, want it admitted", err)
+	}
+}
+
+func TestPauseTypeIsRefusedOnceShutdownStarts(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	bucket.holdPaused = true
+	if err := bucket.pauseType("Image Request"); err != nil {
+		t.Fatalf("pauseType = %v, want nil", err)
+	}
+	spawnWorker(bucket)
+	if err := bucket.tryAdd(request{requestType: "Image Request", requestedAt: time.Now()}); err != nil {
+		t.Fatalf("tryAdd = %v, want it admitted", err)
+	}
+	waitFor(t, time.Second, "the Image Request to be held", func() bool {
+		bucket.mu.Lock()
+		defer bucket.mu.Unlock()
+		return len(bucket.held) == 1
+	})
+
+	// Shutdown resumes the held request; pausing its type again must not hold it a second time.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- bucket.shutdown(ctx) }()
+	waitFor(t, time.Second, "shutdown to start", func() bool {
+		bucket.intake.Lock()
+		defer bucket.intake.Unlock()
+		return bucket.shuttingDown
+	})
+	if err := bucket.pauseType("Image Request"); !errors.Is(err, errShutdown) {
+		t.Fatalf("pauseType during shutdown = %v, want errShutdown", err)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("shutdown = %v, want the held request to drain", err)
+	}
+	if images := bucket.processedByType()["Image Request"]; images != 1 {
+		t.Fatalf("%d Image Requests were processed, want the held one drained", images)
+	}
+}
+
+func TestReadySucceedsOnlyForAWorkingBucket(t *testing.T) {
+	healthy := newTestBucket(10, 1, 1)
+	var audit bytes.Buffer
+	healthy.auditWriter = &audit
+	var completed atomic.Int64
+	healthy.onComplete = func(req request) { completed.Add(1) }
+	healthy.orderedCompletions = true
+	spawnWorker(healthy)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := healthy.ready(ctx); err != nil {
+		t.Fatalf("ready() of a healthy bucket = %v, want nil", err)
+	}
+	// The probe stays out of the bucket's records, and does not hold up the completions after it.
+	healthy.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	waitFor(t, time.Second, "the request after the probe to complete", func() bool { return completed.Load() == 1 })
+	shutdownTestBucket(t, healthy)
+	if probes := healthy.processedByType()[selfTestRequestType]; probes != 0 {
+		t.Fatalf("%d self-test requests counted by type, want the probe left out", probes)
+	}
+	if calls := completed.Load(); calls != 1 {
+		t.Fatalf("onComplete was called %d times, want only for the request after the probe", calls)
+	}
+	if strings.Contains(audit.String(), selfTestRequestType) {
+		t.Fatalf("the audit log records the probe:\n%s", audit.String())
+	}
+
+	// A probe checks only the bucket it was sent to, so it is not mirrored to a shadow.
+	primary := newTestBucket(10, 1, 1)
+	primary.shadow = newTestBucket(10, 1, 1)
+	spawnWorker(primary)
+	spawnWorker(primary.shadow)
+	if err := primary.ready(ctx); err != nil {
+		t.Fatalf("ready() of a bucket with a shadow = %v, want nil", err)
+	}
+	if admitted := primary.shadow.stats().admitted; admitted != 0 {
+		t.Fatalf("the shadow admitted %d requests, want the probe not mirrored", admitted)
+	}
+	shutdownTestBucket(t, primary)
+	shutdownTestBucket(t, primary.shadow)
+
+	// Processing that never finishes leaves the self-test request unprocessed.
+	broken := newTestBucket(10, 1, 1)
+	unblock := make(chan struct{})
+	broken.setProcess(func(batch []request) { <-unblock })
+	spawnWorker(broken)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := broken.ready(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ready() of a bucket whose processing hangs = %v, want context.DeadlineExceeded", err)
+	}
+	close(unblock)
+	shutdownTestBucket(t, broken)
+
+	full := newTestBucket(1, 1, 1)
+	full.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	if err := full.ready(context.Background()); !errors.Is(err, errBucketFull) {
+		t.Fatalf("ready() of a full bucket = %v, want errBucketFull", err)
+	}
+}
+
+func TestKeyLimitThrottlesOneKeyButNotOthers(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	bucket.keyLimit = 2
+	add := func(key string) error {
+		return bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now(), key: key})
+	}
+	for i := 0; i < 2; i++ {
+		if err := add("noisy"); err != nil {
+			t.Fatalf("tryAdd %d for a key under its limit = %v, want it admitted", i, err)
+		}
+	}
+	if err := add("noisy"); !errors.Is(err, errKeyLimit) {
+		t.Fatalf("tryAdd for a key at its limit = %v, want errKeyLimit", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := add(fmt.Sprintf("quiet-%d", i)); err != nil {
+			t.Fatalf("tryAdd for another key = %v, want it admitted into the remaining capacity", err)
+		}
+	}
+	if err := add(""); err != nil {
+		t.Fatalf("tryAdd without a key = %v, want it admitted", err)
+	}
+
+	// Once one of the key's requests leaves the queue, the key is admitted again.
+	spawnWorker(bucket)
+	waitFor(t, time.Second, "the queue to drain", func() bool { return bucket.quiesced() })
+	if err := add("noisy"); err != nil {
+		t.Fatalf("tryAdd for the key once its requests were processed = %v, want it admitted", err)
+	}
+	shutdownTestBucket(t, bucket)
+}
+
+func TestHeadroomIsRelativeToTheTargetUtilization(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	for _, tc := range []struct {
+		depth      int
+		targetUtil float64
+		want       int
+	}{
+		{depth: 0, targetUtil: 0.8, want: 8},
+		{depth: 3, targetUtil: 0.8, want: 5},
+		{depth: 7, targetUtil: 0.8, want: 1},
+		{depth: 8, targetUtil: 0.8, want: 0},
+		{depth: 10, targetUtil: 0.8, want: 0},
+		{depth: 3, targetUtil: 1, want: 7},
+		{depth: 3, targetUtil: 0.25, want: 0},
+	} {
+		bucket.swapQueue(nil)
+		for i := 0; i < tc.depth; i++ {
+			bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+		}
+		if got := bucket.headroom(tc.targetUtil); got != tc.want {
+			t.Errorf("headroom(%v) at depth %d = %d, want %d", tc.targetUtil, tc.depth, got, tc.want)
+		}
+	}
+}
+
+func TestProducerStopsAfterMaxProduced(t *testing.T) {
+	bucket := newTestBucket(2, 1, 1)
+	bucket.maxProduced = 4
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		receiveRequests(bucket)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the producer was still running after offering maxProduced requests")
+	}
+
+	// With no workers the bucket fills after two, so the rest of the requests offered are dropped.
+	stats := bucket.stats()
+	if offered := uint64(stats.depth) + stats.dropped; offered != 4 {
+		t.Fatalf("the producer offered %d requests, %d admitted and %d dropped, want exactly 4", offered, stats.depth, stats.dropped)
+	}
+	spawnWorker(bucket)
+	shutdownTestBucket(t, bucket)
+}
+
+func TestActiveGoroutinesTracksTheBucketsGoroutines(t *testing.T) {
+	bucket := newTestBucket(10, 4, 2)
+	// A long scaleInterval keeps the adjuster running without it resizing the pool under the test.
+	bucket.scaleInterval = time.Hour
+	for i := 0; i < 2; i++ {
+		spawnWorker(bucket)
+	}
+	go workerPoolSizeAdjuster(bucket)
+	go receiveRequests(bucket)
+	waitFor(t, time.Second, "two workers, the adjuster, and the producer", func() bool { return bucket.activeGoroutines() == 4 })
+
+	spawnWorker(bucket)
+	waitFor(t, time.Second, "the new worker to be counted", func() bool { return bucket.activeGoroutines() == 5 })
+
+	bucket.stopNewestWorker()
+	waitFor(t, time.Second, "the stopped worker to stop being counted", func() bool { return bucket.activeGoroutines() == 4 })
+
+	shutdownTestBucket(t, bucket)
+	waitFor(t, time.Second, "every Go routine to exit", func() bool { return bucket.activeGoroutines() == 0 })
+}
+
+func TestExtractUnderConcurrentProducersLosesNothing(t *testing.T) {
+	bucket := newTestBucket(20, 1, 1)
+	var mu sync.Mutex
+	admitted := make(map[string]bool)
+	var producers sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		producers.Add(1)
+		go func(p int) {
+			defer producers.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("%d-%d", p, i)
+				if bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now(), key: key}) == nil {
+					mu.Lock()
+					admitted[key] = true
+					mu.Unlock()
+				}
+			}
+		}(p)
+	}
+
+	seen := make(map[string]int)
+	collect := func(reqs []request) {
+		for _, req := range reqs {
+			seen[req.key]++
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		producers.Wait()
+		close(done)
+	}()
+	for extracting := true; extracting; {
+		select {
+		case <-done:
+			extracting = false
+		default:
+			collect(bucket.extract())
+		}
+	}
+	// What remains once the producers are done is the rest of what was admitted.
+	collect(bucket.extract())
+
+	mu.Lock()
+	defer mu.Unlock()
+	for key, times := range seen {
+		if times != 1 {
+			t.Errorf("request %s was extracted %d times, want once", key, times)
+		}
+		if !admitted[key] {
+			t.Errorf("request %s was extracted without having been admitted", key)
+		}
+	}
+	if len(seen) != len(admitted) {
+		t.Fatalf("extracted %d distinct requests of the %d admitted, want all of them", len(seen), len(admitted))
+	}
+	if depth := bucket.depth(); depth != 0 {
+		t.Fatalf("%d requests queued after the final extract, want none", depth)
+	}
+}
+
+func TestStallWatchdogReplacesAWedgedPool(t *testing.T) {
+	bucket := newTestBucket(20, 4, 2)
+	bucket.scaleInterval = 5 * time.Millisecond
+	bucket.stallWindow = 20 * time.Millisecond
+	// The first batch each original worker takes wedges it; the workers replacing them process normally.
+	var calls atomic.Int64
+	unstuck := make(chan struct{})
+	bucket.setProcess(func(batch []request) {
+		if calls.Add(1) <= 2 {
+			<-unstuck
+		}
+	})
+	for i := 0; i < 2; i++ {
+		spawnWorker(bucket)
+	}
+	for i := 0; i < 20; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	waitFor(t, time.Second, "both workers to wedge", func() bool { return calls.Load() == 2 })
+	go workerPoolSizeAdjuster(bucket)
+
+	waitFor(t, 2*time.Second, "processing to resume", func() bool { return bucket.stats().processed == 18 })
+	if wedged := bucket.wedgedCount(); wedged != 2 {
+		t.Fatalf("%d workers set aside as wedged, want the watchdog to have replaced both", wedged)
+	}
+	close(unstuck)
+	shutdownTestBucket(t, bucket)
+}
+
+func TestHandoverCanBeRepeatedWithOneAdjusterRunning(t *testing.T) {
+	bucket := newTestBucket(10, 2, 1)
+	bucket.scaleInterval = 5 * time.Millisecond
+	go workerPoolSizeAdjuster(bucket)
+	waitFor(t, time.Second, "the adjuster to start", func() bool { return bucket.adjusting.Load() })
+	if !bucket.handover() {
+		t.Fatal("the first handover returned false")
+	}
+
+	go workerPoolSizeAdjuster(bucket)
+	waitFor(t, time.Second, "the new owner's adjuster to start", func() bool { return bucket.activeGoroutines() == 1 })
+	// The detached adjuster must not clear the new owner's flag after acknowledging the handover.
+	time.Sleep(20 * time.Millisecond)
+	if !bucket.adjusting.Load() {
+		t.Fatal("the new owner's adjuster is running with adjusting cleared")
+	}
+	refused := make(chan struct{})
+	go func() {
+		defer close(refused)
+		workerPoolSizeAdjuster(bucket)
+	}()
+	select {
+	case <-refused:
+	case <-time.After(time.Second):
+		t.Fatal("a second adjuster started alongside the new owner's")
+	}
+	if goroutines := bucket.activeGoroutines(); goroutines != 1 {
+		t.Fatalf("%d adjusters running, want exactly one", goroutines)
+	}
+
+	if !bucket.handover() {
+		t.Fatal("handing over from the new owner returned false")
+	}
+	if goroutines := bucket.activeGoroutines(); goroutines != 0 || bucket.adjusting.Load() {
+		t.Fatalf("%d adjusters still counted after the handover returned, want the old one gone", goroutines)
+	}
+	shutdownTestBucket(t, bucket)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// loadTestConfig describes the traffic a load test offers and the bucket it drives.
+type loadTestConfig struct {
+	// rate is how many requests are offered to the bucket per second.
+	rate float64
+	// duration is how long requests are offered for.
+	duration time.Duration
+	// drainTimeout is how long to wait after offering stops for admitted requests to finish processing.
+	drainTimeout time.Duration
+	capacity     int
+	workerCap    int
+	workerMin    int
+}
+
+// loadTestReport summarizes the outcome of a load test.
+type loadTestReport struct {
+	offered  int
+	admitted int
+	dropped  int
+	// completed is how many admitted requests finished processing before the drain timeout.
+	completed int
+	// p50 and p99 are percentiles of the time from a request being offered to it finishing processing.
+	p50         time.Duration
+	p99         time.Duration
+	peakWorkers int
+}
+
+// runLoadTest offers requests to a freshly initialized bucket at the configured rate for the configured
+// duration, waits for admitted requests to drain, shuts the bucket down, and reports how the bucket
+// handled the load.
+func runLoadTest(config loadTestConfig) loadTestReport {
+	bucket := initializeBucket("Load Test Bucket", config.capacity, config.workerCap, config.workerMin)
+
+	var latenciesMu sync.Mutex
+	latencies := make([]time.Duration, 0)
+	bucket.onComplete = func(req request) {
+		latenciesMu.Lock()
+		defer latenciesMu.Unlock()
+		latencies = append(latencies, bucket.since(req.requestedAt))
+	}
+
+	for i := 0; i < config.workerMin; i++ {
+		spawnWorker(bucket)
+	}
+	go workerPoolSizeAdjuster(bucket)
+
+	report := loadTestReport{}
+	sampleWorkers := func() {
+		if workers := bucket.workerCount(); workers > report.peakWorkers {
+			report.peakWorkers = workers
+		}
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / config.rate))
+	deadline := time.After(config.duration)
+	for offering := true; offering; {
+		select {
+		case <-ticker.C:
+			report.offered++
+			if bucket.tryAdd(request{requestType: "Load Test", requestedAt: bucket.requestTime()}) == nil {
+				report.admitted++
+			} else {
+				report.dropped++
+			}
+			sampleWorkers()
+		case <-deadline:
+			offering = false
+		}
+	}
+	ticker.Stop()
+
+	drainDeadline := time.Now().Add(config.drainTimeout)
+	for bucket.stats().processed < uint64(report.admitted) && time.Now().Before(drainDeadline) {
+		sampleWorkers()
+		time.Sleep(10 * time.Millisecond)
+	}
+	drained, cancel := context.WithDeadline(context.Background(), drainDeadline)
+	defer cancel()
+	if err := bucket.shutdown(drained); err != nil {
+		fmt.Printf("Unable to shut down the load tested bucket: %v\n", err)
+	}
+
+	latenciesMu.Lock()
+	defer latenciesMu.Unlock()
+	report.completed = len(latencies)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report.p50 = percentile(latencies, 0.50)
+	report.p99 = percentile(latencies, 0.99)
+	return report
+}
+
+// percentile returns the p-th percentile, from 0 to 1, of the sorted durations, or 0 if there are none.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	index := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return sorted[index]
+}
+
+// print writes the report to standard output.
+func (report loadTestReport) print() {
+	fmt.Println("Load test report")
+	fmt.Printf("  Offered:      %d\n", report.offered)
+	fmt.Printf("  Admitted:     %d\n", report.admitted)
+	fmt.Printf("  Dropped:      %d\n", report.dropped)
+	fmt.Printf("  Completed:    %d\n", report.completed)
+	fmt.Printf("  p50 latency:  %s\n", report.p50)
+	fmt.Printf("  p99 latency:  %s\n", report.p99)
+	fmt.Printf("  Peak workers: %d\n", report.peakWorkers)
+}
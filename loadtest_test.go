@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadTestReportIsConsistent(t *testing.T) {
+	report := runLoadTest(loadTestConfig{
+		rate:         100,
+		duration:     200 * time.Millisecond,
+		drainTimeout: 5 * time.Second,
+		capacity:     10,
+		workerCap:    5,
+		workerMin:    5,
+	})
+	if report.offered == 0 || report.admitted == 0 || report.dropped == 0 {
+		t.Fatalf("report = %+v, want requests offered, admitted, and dropped", report)
+	}
+	if report.admitted+report.dropped != report.offered {
+		t.Errorf("admitted %d + dropped %d != offered %d", report.admitted, report.dropped, report.offered)
+	}
+	if report.completed != report.admitted {
+		t.Errorf("completed %d of the %d admitted requests, want all of them within the drain timeout", report.completed, report.admitted)
+	}
+	if report.p50 <= 0 || report.p50 > report.p99 {
+		t.Errorf("p50 %s and p99 %s, want 0 < p50 <= p99", report.p50, report.p99)
+	}
+	if report.peakWorkers != 5 {
+		t.Errorf("peak workers = %d, want the 5 the pool is pinned to", report.peakWorkers)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for _, tc := range []struct {
+		p    float64
+		want time.Duration
+	}{{0, 1}, {0.5, 5}, {0.99, 10}, {1, 10}} {
+		if got := percentile(sorted, tc.p); got != tc.want {
+			t.Errorf("percentile(%v) = %d, want %d", tc.p, got, tc.want)
+		}
+	}
+	if got := percentile(nil, 0.5); got != 0 {
+		t.Errorf("percentile of no durations = %d, want 0", got)
+	}
+}
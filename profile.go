@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// hotPathOperation identifies one of the operations on a bucket's hot path that can be profiled.
+type hotPathOperation int
+
+const (
+	// admissionOperation covers deciding whether to admit a request, including enqueueing it.
+	admissionOperation hotPathOperation = iota
+	// enqueueOperation covers placing an admitted request on the bucket.
+	enqueueOperation
+	// dequeueOperation covers the bookkeeping done as a worker takes a request off the bucket.
+	dequeueOperation
+	// processOperation covers a worker processing a batch of requests.
+	processOperation
+	hotPathOperations
+)
+
+// String returns the operation's name as used in profile reports.
+func (op hotPathOperation) String() string {
+	switch op {
+	case admissionOperation:
+		return "admission"
+	case enqueueOperation:
+		return "enqueue"
+	case dequeueOperation:
+		return "dequeue"
+	case processOperation:
+		return "process"
+	default:
+		return "unknown"
+	}
+}
+
+// histogramBounds are the upper bounds of each histogram bucket but the last, which holds every
+// duration above the final bound.
+var histogramBounds = [...]time.Duration{
+	time.Microsecond,
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// durationHistogram counts durations into buckets bounded by histogramBounds.
+type durationHistogram struct {
+	counts [len(histogramBounds) + 1]atomic.Uint64
+}
+
+// observe counts d in the histogram bucket it falls in.
+func (histogram *durationHistogram) observe(d time.Duration) {
+	for i, bound := range histogramBounds {
+		if d <= bound {
+			histogram.counts[i].Add(1)
+			return
+		}
+	}
+	histogram.counts[len(histogramBounds)].Add(1)
+}
+
+// hotPathProfile holds a histogram of timings for each hot path operation of a bucket.
+// Recording is gated by enabled, so a disabled profile costs a single atomic load per operation.
+type hotPathProfile struct {
+	enabled    atomic.Bool
+	histograms [hotPathOperations]durationHistogram
+}
+
+// start returns the time an operation started if profiling is enabled, or the zero time otherwise.
+func (profile *hotPathProfile) start() time.Time {
+	if profile == nil || !profile.enabled.Load() {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// finish records how long op took since started, as returned by start. Nothing is recorded if
+// profiling was disabled when the operation started.
+func (profile *hotPathProfile) finish(op hotPathOperation, started time.Time) {
+	if started.IsZero() {
+		return
+	}
+	profile.histograms[op].observe(time.Since(started))
+}
+
+// snapshot returns the histogram counts for every operation, keyed by operation name. Each slice holds a
+// count per histogramBounds bound followed by the count of durations above the final bound.
+func (profile *hotPathProfile) snapshot() map[string][]uint64 {
+	snapshot := make(map[string][]uint64, hotPathOperations)
+	for op := hotPathOperation(0); op < hotPathOperations; op++ {
+		counts := make([]uint64, len(histogramBounds)+1)
+		for i := range counts {
+			counts[i] = profile.histograms[op].counts[i].Load()
+		}
+		snapshot[op.String()] = counts
+	}
+	return snapshot
+}
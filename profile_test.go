@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHotPathProfileHistogramsPopulateWhenEnabled(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	for op, counts := range bucket.profile.snapshot() {
+		for _, count := range counts {
+			if count != 0 {
+				t.Fatalf("%s histogram is %v while profiling is disabled, want it empty", op, counts)
+			}
+		}
+	}
+
+	bucket.profile.enabled.Store(true)
+	for i := 0; i < 5; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	spawnWorker(bucket)
+	waitFor(t, time.Second, "the requests to be processed", func() bool { return bucket.stats().processed == 6 })
+	shutdownTestBucket(t, bucket)
+
+	want := map[string]uint64{"admission": 5, "enqueue": 5, "dequeue": 6, "process": 1}
+	for op, counts := range bucket.profile.snapshot() {
+		var total uint64
+		for _, count := range counts {
+			total += count
+		}
+		if total < want[op] {
+			t.Errorf("%s histogram counted %d timings, want at least %d", op, total, want[op])
+		}
+	}
+}
+
+func BenchmarkHotPathProfile(b *testing.B) {
+	for _, enabled := range []bool{false, true} {
+		name := "disabled"
+		if enabled {
+			name = "enabled"
+		}
+		b.Run(name, func(b *testing.B) {
+			profile := &hotPathProfile{}
+			profile.enabled.Store(enabled)
+			for i := 0; i < b.N; i++ {
+				profile.finish(admissionOperation, profile.start())
+			}
+		})
+	}
+}
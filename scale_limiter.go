@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// scaleLimiter gates how often worker pool scaling actions happen across every bucket sharing it, so many
+// buckets scaling at the same moment cannot spike resource usage. Permits leak in at a fixed rate, and
+// adjusters wanting to scale beyond that rate queue until a permit arrives.
+type scaleLimiter struct {
+	permits  chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// newScaleLimiter creates a scale limiter allowing perSecond scaling actions per second in total, which must be
+// positive, and starts issuing permits. It should be stopped once the buckets sharing it have been shut down.
+func newScaleLimiter(perSecond int) *scaleLimiter {
+	limiter := &scaleLimiter{
+		permits: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go limiter.issue(time.Second / time.Duration(perSecond))
+	return limiter
+}
+
+// issue hands out one permit every interval to a waiting adjuster. Intended to be run as a Go routine,
+// it runs until the limiter is stopped.
+func (limiter *scaleLimiter) issue(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-limiter.stopped:
+			return
+		case <-ticker.C:
+		}
+		select {
+		case limiter.permits <- struct{}{}:
+		case <-limiter.stopped:
+			return
+		}
+	}
+}
+
+// acquire blocks until a scaling action is permitted, returning false instead if cancel is closed or the
+// limiter is stopped first. A nil limiter permits every action immediately.
+func (limiter *scaleLimiter) acquire(cancel <-chan struct{}) bool {
+	if limiter == nil {
+		return true
+	}
+	select {
+	case <-limiter.permits:
+		return true
+	case <-cancel:
+		return false
+	case <-limiter.stopped:
+		return false
+	}
+}
+
+// stop stops issuing permits and releases any adjusters waiting for one. It is safe to call more than once.
+func (limiter *scaleLimiter) stop() {
+	limiter.stopOnce.Do(func() { close(limiter.stopped) })
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScaleLimiterBoundsScalingAcrossBuckets(t *testing.T) {
+	const perSecond = 20
+	limiter := newScaleLimiter(perSecond)
+	unblock := make(chan struct{})
+	buckets := make([]*leakyBucket, 5)
+	for i := range buckets {
+		bucket := newTestBucket(20, 10, 1)
+		bucket.scaleInterval = 5 * time.Millisecond
+		bucket.scaleLimiter = limiter
+		bucket.setProcess(func(batch []request) { <-unblock })
+		spawnWorker(bucket)
+		// Saturate every bucket so each adjuster wants to scale up on every evaluation.
+		for j := 0; j < 20; j++ {
+			bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+		}
+		buckets[i] = bucket
+	}
+
+	const window = 500 * time.Millisecond
+	started := time.Now()
+	for _, bucket := range buckets {
+		go workerPoolSizeAdjuster(bucket)
+	}
+	time.Sleep(window)
+	limiter.stop()
+	took := time.Since(started)
+
+	scaled := 0
+	for _, bucket := range buckets {
+		scaled += bucket.workerCount() - 1
+	}
+	// One permit may already be waiting when the window opens.
+	if limit := int(took.Seconds()*perSecond) + 1; scaled > limit {
+		t.Fatalf("%d scaling actions in %s across the buckets, want at most %d", scaled, took, limit)
+	}
+	if scaled == 0 {
+		t.Fatal("no bucket scaled up, want the limiter to permit some scaling")
+	}
+
+	close(unblock)
+	for _, bucket := range buckets {
+		shutdownTestBucket(t, bucket)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+)
+
+// semaphoreRequestType is the request type placed on a bucket for each slot held through acquire.
+const semaphoreRequestType = "Semaphore Slot"
+
+// acquire uses the bucket as a counting semaphore, blocking until the bucket has room and then holding
+// one slot of its capacity until release is called. When the bucket has a pace set, acquisitions are
+// also spaced at least pace apart. A bucket used as a semaphore must not have any workers running, since
+// they would take the held slots off the bucket. Each slot is admitted like any other request, so it is
+// written to the admission log and passed to onEnqueue, and a slot refused for any reason other than the
+// bucket being full, such as intake being paused under memory pressure, returns that error straight away.
+// It returns ctx's error if ctx is done before a slot frees up, or errShutdown once the bucket is shutting down.
+func (bucket *leakyBucket) acquire(ctx context.Context) error {
+	if !bucket.initialized() {
+		return errNotInitialized
+	}
+	for {
+		bucket.intake.Lock()
+		if bucket.shuttingDown || bucket.depth() < bucket.capacity() {
+			slot := request{requestType: semaphoreRequestType, requestedAt: bucket.requestTime()}
+			err := bucket.admitLocked(slot)
+			// Several slots may have been freed while only one wakeup could be pending, so pass the
+			// wakeup on to the next waiter while there is still room.
+			if err == nil && bucket.depth() < bucket.capacity() {
+				bucket.wakeAcquirer()
+			}
+			bucket.intake.Unlock()
+			bucket.logAdmission(slot, err)
+			if err != nil {
+				return err
+			}
+			bucket.awaitPace()
+			return nil
+		}
+		bucket.intake.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-bucket.slotFreed:
+		case <-bucket.closing:
+		}
+	}
+}
+
+// release returns a slot held through acquire to the bucket, waking a caller waiting to acquire one.
+// The slot counts as processed, so the bucket's stats cover how often and for how long slots were held,
+// and it is reported to onComplete. Releasing when no slot is held does nothing.
+func (bucket *leakyBucket) release() {
+	if !bucket.initialized() {
+		return
+	}
+	select {
+	case req := <-bucket.requestChannel:
+		bucket.dequeued(req, true)
+		bucket.recordProcessed(req)
+		bucket.complete(req)
+	default:
+		return
+	}
+	bucket.wakeAcquirer()
+}
+
+// wakeAcquirer wakes a caller waiting in acquire, if one is not already due to wake.
+func (bucket *leakyBucket) wakeAcquirer() {
+	select {
+	case bucket.slotFreed <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcquireBlocksAtCapacityUntilRelease(t *testing.T) {
+	bucket := newTestBucket(2, 1, 1)
+	for i := 0; i < 2; i++ {
+		if err := bucket.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire %d: %v", i, err)
+		}
+	}
+	acquired := make(chan error, 1)
+	go func() { acquired <- bucket.acquire(context.Background()) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquire on a full bucket returned %v instead of blocking", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	bucket.release()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("acquire after release: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire did not unblock after release")
+	}
+	if dropped := bucket.stats().dropped; dropped != 0 {
+		t.Fatalf("waiting for a slot recorded %d drops, want 0", dropped)
+	}
+}
+
+func TestAcquireRespectsContextCancellation(t *testing.T) {
+	bucket := newTestBucket(1, 1, 1)
+	if err := bucket.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := bucket.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire on a full bucket = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestAcquireGoesThroughAdmission(t *testing.T) {
+	bucket := newTestBucket(4, 1, 1)
+	enqueued := 0
+	bucket.onEnqueue = func(req *request) { enqueued++ }
+	if err := bucket.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if enqueued != 1 {
+		t.Fatalf("onEnqueue was called %d times for one slot, want 1", enqueued)
+	}
+
+	bucket.intake.Lock()
+	bucket.pauseIntake(time.Minute, errMemoryPressure)
+	bucket.intake.Unlock()
+	if err := bucket.acquire(context.Background()); !errors.Is(err, errMemoryPressure) {
+		t.Fatalf("acquire while intake is paused = %v, want errMemoryPressure", err)
+	}
+}
+
+func TestReleaseReportsOrderedCompletions(t *testing.T) {
+	bucket := newTestBucket(4, 1, 1)
+	bucket.orderedCompletions = true
+	var mu sync.Mutex
+	var completed []uint64
+	bucket.onComplete = func(req request) {
+		mu.Lock()
+		defer mu.Unlock()
+		completed = append(completed, req.sequence)
+	}
+	for i := 0; i < 3; i++ {
+		if err := bucket.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire %d: %v", i, err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		bucket.release()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(completed) != 3 || completed[0] != 0 || completed[2] != 2 {
+		t.Fatalf("completions reported = %v, want [0 1 2]", completed)
+	}
+	if stats := bucket.stats(); stats.processed != 3 || stats.inFlight != 0 {
+		t.Fatalf("after releasing every slot, processed = %d and in flight = %d, want 3 and 0", stats.processed, stats.inFlight)
+	}
+}
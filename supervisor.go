@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// supervisor owns a bucket and everything that runs it: the request producer, the workers, the worker
+// pool size adjuster, and optionally the leak loop. They are started together by start and stopped
+// together when its context is done or stop is called, and any errors they hit are reported through a
+// single channel.
+type supervisor struct {
+	bucket *leakyBucket
+	// leakInterval, when positive, gates processing with the bucket's leak loop at this interval.
+	leakInterval time.Duration
+	// drainTimeout, when positive, bounds how long stopping waits for the bucket to drain. A bucket that
+	// does not drain in time is reported as an error on the errors channel.
+	drainTimeout time.Duration
+	cancel       context.CancelFunc
+	done         chan struct{}
+	// errsMu guards errs and stopped, so no error is sent once errs has been closed.
+	errsMu  sync.Mutex
+	errs    chan error
+	stopped bool
+}
+
+// newSupervisor returns a supervisor for bucket, ready to be started. Every worker the bucket spawns from
+// then on, including replacements and warm pool workers, runs under the supervisor's panic reporting.
+func newSupervisor(bucket *leakyBucket) *supervisor {
+	s := &supervisor{
+		bucket: bucket,
+		errs:   make(chan error, 16),
+		done:   make(chan struct{}),
+	}
+	bucket.launch = s.run
+	return s
+}
+
+// start launches the bucket's producer, its minimum number of workers, its worker pool size adjuster,
+// and its leak loop if leakInterval is set. They run until ctx is done or stop is called, at which point
+// the bucket is shut down gracefully and the errors channel is closed. An error is returned, and nothing
+// is started, if the bucket was not initialized.
+func (s *supervisor) start(ctx context.Context) error {
+	if !s.bucket.initialized() {
+		return errNotInitialized
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+
+	if s.leakInterval > 0 {
+		s.bucket.startLeakGate(s.leakInterval)
+	}
+	s.run("the request producer", func() { receiveRequests(s.bucket) })
+	for i := 0; i < s.bucket.workerMin; i++ {
+		spawnWorker(s.bucket)
+	}
+	s.run("the worker pool size adjuster", func() { workerPoolSizeAdjuster(s.bucket) })
+
+	go func() {
+		<-ctx.Done()
+		drain := context.Background()
+		if s.drainTimeout > 0 {
+			var cancel context.CancelFunc
+			drain, cancel = context.WithTimeout(drain, s.drainTimeout)
+			defer cancel()
+		}
+		if err := s.bucket.shutdown(drain); err != nil {
+			s.report(err)
+		}
+		s.errsMu.Lock()
+		s.stopped = true
+		close(s.errs)
+		s.errsMu.Unlock()
+		close(s.done)
+	}()
+	return nil
+}
+
+// run runs subsystem in its own Go routine, reporting a panic in it as an error rather than letting it
+// take down the process.
+func (s *supervisor) run(name string, subsystem func()) {
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				s.report(fmt.Errorf("%s of %s panicked: %v", name, s.bucket.name, recovered))
+			}
+		}()
+		subsystem()
+	}()
+}
+
+// report delivers err on the errors channel. If nobody is keeping up with the channel, the error is
+// printed instead so reporting never blocks a subsystem.
+func (s *supervisor) report(err error) {
+	s.errsMu.Lock()
+	defer s.errsMu.Unlock()
+	if s.stopped {
+		fmt.Printf("Supervisor error after stopping: %v\n", err)
+		return
+	}
+	select {
+	case s.errs <- err:
+	default:
+		fmt.Printf("Supervisor error: %v\n", err)
+	}
+}
+
+// errors returns the channel errors from the supervised subsystems are reported on. It is closed once
+// the supervisor has stopped.
+func (s *supervisor) errors() <-chan error {
+	return s.errs
+}
+
+// stop shuts down the bucket and everything the supervisor started, returning once the bucket has
+// drained and every worker has exited, or once drainTimeout runs out.
+func (s *supervisor) stop() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSupervisorStartsAndStopsTogether(t *testing.T) {
+	bucket := newTestBucket(10, 3, 2)
+	bucket.scaleInterval = 5 * time.Millisecond
+	s := newSupervisor(bucket)
+	s.leakInterval = time.Millisecond
+	s.drainTimeout = 5 * time.Second
+	if err := s.start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	// The producer, both workers, and the adjuster all run on the bucket.
+	waitFor(t, 2*time.Second, "every subsystem to start", func() bool { return bucket.activeGoroutines() >= 4 })
+	waitFor(t, 2*time.Second, "a request to be processed", func() bool { return bucket.stats().processed > 0 })
+
+	s.stop()
+	for err := range s.errors() {
+		t.Errorf("unexpected supervisor error: %v", err)
+	}
+	waitFor(t, time.Second, "every subsystem to stop", func() bool { return bucket.activeGoroutines() == 0 })
+	if err := bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()}); err != errShutdown {
+		t.Fatalf("tryAdd after stop = %v, want errShutdown", err)
+	}
+}
+
+func TestSupervisorReportsWorkerPanics(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	bucket.setProcess(func(batch []request) { panic("downstream exploded") })
+	s := newSupervisor(bucket)
+	s.drainTimeout = 100 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	select {
+	case err := <-s.errors():
+		if !strings.Contains(err.Error(), "Worker 1 of Test Bucket panicked: downstream exploded") {
+			t.Fatalf("first supervisor error = %v, want Worker 1's panic", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the worker's panic to be reported")
+	}
+
+	cancel()
+	for range s.errors() {
+	}
+}
+
+func TestSupervisorReportsLeakLoopPanics(t *testing.T) {
+	bucket := newTestBucket(10, 1, 1)
+	s := newSupervisor(bucket)
+	s.drainTimeout = 100 * time.Millisecond
+	// A leak gate without a positive interval panics as soon as its ticker is created.
+	bucket.startLeakGate(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	select {
+	case err := <-s.errors():
+		if !strings.Contains(err.Error(), "the leak loop of Test Bucket panicked") {
+			t.Fatalf("first supervisor error = %v, want the leak loop's panic", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the leak loop's panic to be reported")
+	}
+
+	cancel()
+	for range s.errors() {
+	}
+}
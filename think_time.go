@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// thinkTime is a distribution of how long workers spend processing each request, for simulating
+// workloads whose processing times vary. Samples are drawn from the bucket's seeded random source.
+type thinkTime interface {
+	sample(rng *rand.Rand) time.Duration
+	mean() time.Duration
+}
+
+// deterministicThinkTime always takes the same duration.
+type deterministicThinkTime struct {
+	duration time.Duration
+}
+
+func (t deterministicThinkTime) sample(rng *rand.Rand) time.Duration {
+	return t.duration
+}
+
+func (t deterministicThinkTime) mean() time.Duration {
+	return t.duration
+}
+
+// uniformThinkTime takes a duration drawn uniformly between min and max.
+type uniformThinkTime struct {
+	min time.Duration
+	max time.Duration
+}
+
+func (t uniformThinkTime) sample(rng *rand.Rand) time.Duration {
+	if t.max <= t.min {
+		return t.min
+	}
+	return t.min + time.Duration(rng.Int63n(int64(t.max-t.min)))
+}
+
+func (t uniformThinkTime) mean() time.Duration {
+	return t.min + (t.max-t.min)/2
+}
+
+// normalThinkTime takes a duration drawn from a normal distribution with the given mean and standard
+// deviation. Samples that would be negative take no time at all.
+type normalThinkTime struct {
+	average time.Duration
+	stdDev  time.Duration
+}
+
+func (t normalThinkTime) sample(rng *rand.Rand) time.Duration {
+	duration := t.average + time.Duration(rng.NormFloat64()*float64(t.stdDev))
+	if duration < 0 {
+		return 0
+	}
+	return duration
+}
+
+func (t normalThinkTime) mean() time.Duration {
+	return t.average
+}
+
+// exponentialThinkTime takes a duration drawn from an exponential distribution with the given mean,
+// modeling processing where most requests are quick but a few take much longer.
+type exponentialThinkTime struct {
+	average time.Duration
+}
+
+func (t exponentialThinkTime) sample(rng *rand.Rand) time.Duration {
+	return time.Duration(rng.ExpFloat64() * float64(t.average))
+}
+
+func (t exponentialThinkTime) mean() time.Duration {
+	return t.average
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestThinkTimeDistributionsHaveTheExpectedMoments(t *testing.T) {
+	const samples = 100000
+	ms := float64(time.Millisecond)
+	for _, tc := range []struct {
+		name      string
+		thinkTime thinkTime
+		// stdDev is the expected standard deviation of the samples, in milliseconds.
+		stdDev float64
+	}{
+		{"deterministic", deterministicThinkTime{duration: 750 * time.Millisecond}, 0},
+		{"uniform", uniformThinkTime{min: 100 * time.Millisecond, max: 500 * time.Millisecond}, 400 / math.Sqrt(12)},
+		{"normal", normalThinkTime{average: 500 * time.Millisecond, stdDev: 50 * time.Millisecond}, 50},
+		{"exponential", exponentialThinkTime{average: 200 * time.Millisecond}, 200},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			var sum, sumSquares float64
+			for i := 0; i < samples; i++ {
+				sample := float64(tc.thinkTime.sample(rng)) / ms
+				sum += sample
+				sumSquares += sample * sample
+			}
+			mean := sum / samples
+			stdDev := math.Sqrt(sumSquares/samples - mean*mean)
+
+			want := float64(tc.thinkTime.mean()) / ms
+			if math.Abs(mean-want) > 0.02*want {
+				t.Errorf("samples average %.2fms, want within 2%% of %.2fms", mean, want)
+			}
+			if math.Abs(stdDev-tc.stdDev) > 0.02*tc.stdDev+0.01 {
+				t.Errorf("samples have a standard deviation of %.2fms, want within 2%% of %.2fms", stdDev, tc.stdDev)
+			}
+		})
+	}
+}
+
+func TestThinkTimesAreReproducibleFromASeed(t *testing.T) {
+	exponential := exponentialThinkTime{average: 200 * time.Millisecond}
+	first, second := rand.New(rand.NewSource(42)), rand.New(rand.NewSource(42))
+	for i := 0; i < 100; i++ {
+		if a, b := exponential.sample(first), exponential.sample(second); a != b {
+			t.Fatalf("sample %d was %s and %s from the same seed, want them equal", i, a, b)
+		}
+	}
+}
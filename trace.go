@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+// traceRecord is the lifecycle of one processed request kept for exporting as a trace.
+type traceRecord struct {
+	worker      string
+	requestType string
+	sequence    uint64
+	requestedAt time.Time
+	started     time.Time
+	finished    time.Time
+}
+
+// traceEvent is a single event in the Chrome trace event format, as loaded by chrome://tracing.
+// Timestamps and durations are in microseconds. ID pairs the begin and end events of an async event.
+type traceEvent struct {
+	Name      string            `json:"name"`
+	Category  string            `json:"cat,omitempty"`
+	Phase     string            `json:"ph"`
+	ID        string            `json:"id,omitempty"`
+	Timestamp int64             `json:"ts"`
+	Duration  int64             `json:"dur,omitempty"`
+	Process   int               `json:"pid"`
+	Thread    int               `json:"tid"`
+	Args      map[string]string `json:"args,omitempty"`
+}
+
+// recordTrace keeps the lifecycle of each request in batch, processed by worker between started and
+// finished, dropping the oldest records beyond traceLimit. Nothing is kept unless traceLimit is positive.
+func (bucket *leakyBucket) recordTrace(worker worker, batch []request, started time.Time, finished time.Time) {
+	if bucket.traceLimit <= 0 {
+		return
+	}
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	for _, req := range batch {
+		bucket.traces = append(bucket.traces, traceRecord{
+			worker:      worker.name,
+			requestType: req.requestType,
+			sequence:    req.sequence,
+			requestedAt: req.requestedAt,
+			started:     started,
+			finished:    finished,
+		})
+	}
+	if excess := len(bucket.traces) - bucket.traceLimit; excess > 0 {
+		bucket.traces = append(bucket.traces[:0], bucket.traces[excess:]...)
+	}
+}
+
+// queueLane is the trace lane queue waits are drawn on, kept apart from the worker lanes.
+const queueLane = 0
+
+// writeTrace writes the recent request lifecycles as Chrome trace event JSON, which can be loaded in
+// chrome://tracing. Each worker gets its own lane holding a processing event for each request it
+// processed. Queue waits, from when each request was made until a worker started it, overlap one another
+// and the processing of earlier requests, so they are async events on a queue lane of their own.
+func (bucket *leakyBucket) writeTrace(w io.Writer) error {
+	bucket.mu.Lock()
+	records := make([]traceRecord, len(bucket.traces))
+	copy(records, bucket.traces)
+	bucket.mu.Unlock()
+
+	lanes := make(map[string]int)
+	events := make([]traceEvent, 0, 3*len(records)+1)
+	if len(records) > 0 {
+		events = append(events, traceEvent{
+			Name:    "thread_name",
+			Phase:   "M",
+			Process: 1,
+			Thread:  queueLane,
+			Args:    map[string]string{"name": "Queue"},
+		})
+	}
+	for _, record := range records {
+		lane, ok := lanes[record.worker]
+		if !ok {
+			lane = len(lanes) + 1
+			lanes[record.worker] = lane
+			events = append(events, traceEvent{
+				Name:    "thread_name",
+				Phase:   "M",
+				Process: 1,
+				Thread:  lane,
+				Args:    map[string]string{"name": record.worker},
+			})
+		}
+		sequence := strconv.FormatUint(record.sequence, 10)
+		args := map[string]string{
+			"type":     record.requestType,
+			"sequence": sequence,
+		}
+		waitedUntil := record.requestedAt.Add(elapsed(record.requestedAt, record.started))
+		events = append(events,
+			traceEvent{
+				Name:      "queue wait",
+				Category:  "queue",
+				Phase:     "b",
+				ID:        sequence,
+				Timestamp: record.requestedAt.UnixMicro(),
+				Process:   1,
+				Thread:    queueLane,
+				Args:      args,
+			},
+			traceEvent{
+				Name:      "queue wait",
+				Category:  "queue",
+				Phase:     "e",
+				ID:        sequence,
+				Timestamp: waitedUntil.UnixMicro(),
+				Process:   1,
+				Thread:    queueLane,
+			},
+			traceEvent{
+				Name:      "processing",
+				Category:  "process",
+				Phase:     "X",
+				Timestamp: record.started.UnixMicro(),
+				Duration:  elapsed(record.started, record.finished).Microseconds(),
+				Process:   1,
+				Thread:    lane,
+				Args:      args,
+			})
+	}
+	return json.NewEncoder(w).Encode(struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}{events})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestWriteTraceEmitsEventsForProcessedRequests(t *testing.T) {
+	bucket := newTestBucket(10, 2, 2)
+	bucket.traceLimit = 10
+	for i := 0; i < 4; i++ {
+		bucket.tryAdd(request{requestType: "HTML Request", requestedAt: time.Now()})
+	}
+	for i := 0; i < 2; i++ {
+		spawnWorker(bucket)
+	}
+	waitFor(t, time.Second, "the requests to be processed", func() bool { return bucket.stats().processed == 4 })
+	shutdownTestBucket(t, bucket)
+
+	var buf bytes.Buffer
+	if err := bucket.writeTrace(&buf); err != nil {
+		t.Fatalf("writeTrace: %v", err)
+	}
+	var trace struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatalf("trace is not valid JSON: %v\n%s", err, buf.String())
+	}
+
+	waitBegins := make(map[string]int64)
+	waitEnds := make(map[string]int64)
+	processing := make(map[string]int)
+	lanes := make(map[int]bool)
+	slices := make(map[int][]traceEvent)
+	for _, event := range trace.TraceEvents {
+		switch {
+		case event.Phase == "M" && event.Name == "thread_name":
+			lanes[event.Thread] = true
+		case event.Phase == "b" && event.Name == "queue wait":
+			waitBegins[event.ID] = event.Timestamp
+		case event.Phase == "e" && event.Name == "queue wait":
+			waitEnds[event.ID] = event.Timestamp
+		case event.Phase == "X" && event.Name == "processing":
+			processing[event.Args["sequence"]]++
+		default:
+			t.Errorf("unexpected trace event %+v", event)
+		}
+		if event.Phase == "X" {
+			slices[event.Thread] = append(slices[event.Thread], event)
+		}
+		if event.Phase != "M" && (event.Timestamp <= 0 || event.Duration < 0 || !lanes[event.Thread]) {
+			t.Errorf("event %+v has no valid timestamp, duration, or named lane", event)
+		}
+	}
+	for _, sequence := range []string{"0", "1", "2", "3"} {
+		begin, began := waitBegins[sequence]
+		end, ended := waitEnds[sequence]
+		if !began || !ended || end < begin || processing[sequence] != 1 {
+			t.Errorf("request %s has queue wait %d to %d (began %t, ended %t) and %d processing events, want one of each in order",
+				sequence, begin, end, began, ended, processing[sequence])
+		}
+	}
+	// Slices on a lane are drawn as a stack, so they must not overlap, or chrome://tracing misdraws them.
+	for lane, events := range slices {
+		sort.Slice(events, func(i, j int) bool { return events[i].Timestamp < events[j].Timestamp })
+		for i := 1; i < len(events); i++ {
+			if previousEnd := events[i-1].Timestamp + events[i-1].Duration; events[i].Timestamp < previousEnd {
+				t.Errorf("lane %d has %+v starting before %+v ends", lane, events[i], events[i-1])
+			}
+		}
+	}
+}